@@ -50,11 +50,42 @@ func main() {
 	log.Info("Starting config2vault v" + version)
 	log.Info("Connecting to Vault at: " + config.Conf.Url)
 
-	if len(flag.Args()) == 0 {
+	args := flag.Args()
+	if len(args) > 0 && args[0] == "issue-secret-id" {
+		if len(args) < 3 {
+			log.Error("Usage: config2vault issue-secret-id <role> <rules_folder_or_file>")
+			os.Exit(-1)
+		}
+		log.Infof("Issuing SecretID for the AppRole '%s'", args[1])
+		if err := injest.IssueSecretId(injest.ImportPath(args[2]), args[1]); err != nil {
+			log.Errorf("Failed to issue SecretID. %v", err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "check" {
+		if len(args) < 2 {
+			log.Error("Usage: config2vault check <rules_folder_or_file>")
+			os.Exit(-1)
+		}
+		log.Info("Checking Vault against " + args[1])
+		findings, err := injest.Check(injest.ImportPath(args[1]))
+		if err != nil {
+			log.Errorf("Failed to check Vault. %v", err)
+			os.Exit(-1)
+		}
+		if findings > 0 {
+			os.Exit(2)
+		}
+		return
+	}
+
+	if len(args) == 0 {
 		log.Error("Missing path to the ACLs file")
 		os.Exit(-1)
 	}
-	log.Info("Applying Configuration from " + flag.Args()[0])
+	log.Info("Applying Configuration from " + args[0])
 
-	injest.InjestConfig(injest.ImportPath(flag.Args()[0]))
+	injest.InjestConfig(injest.ImportPath(args[0]))
 }
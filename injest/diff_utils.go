@@ -0,0 +1,225 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diffProperties returns the sorted list of desired keys that are different in the current state.
+// Keys that Vault doesn't return back (write-only values) are reported as changed unless ignoreMissing is set.
+func diffProperties(desired map[string]interface{}, current map[string]interface{}, ignoreMissing bool) []string {
+	changed := []string{}
+	for key, desiredValue := range desired {
+		currentValue, ok := current[key]
+		if !ok {
+			if !ignoreMissing {
+				changed = append(changed, key)
+			}
+			continue
+		}
+		if !valuesEqual(desiredValue, currentValue) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// valuesEqual compares a value from the rules with the value Vault returned for the same property.
+// Vault converts durations to seconds, booleans and numbers to their JSON types and comma separated
+// strings to lists, so both sides are normalised before comparing.
+func valuesEqual(desired interface{}, current interface{}) bool {
+	left := normalizeValue(desired)
+	right := normalizeValue(current)
+
+	switch l := left.(type) {
+	case string:
+		switch r := right.(type) {
+		case string:
+			return l == r || durationsEqual(l, r)
+		case []string:
+			return reflect.DeepEqual(splitList(l), r)
+		}
+	case []string:
+		switch r := right.(type) {
+		case string:
+			return reflect.DeepEqual(l, splitList(r))
+		case []string:
+			return reflect.DeepEqual(l, r)
+		}
+	case map[string]interface{}:
+		r, ok := right.(map[string]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for key, value := range l {
+			if !valuesEqual(value, r[key]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []string:
+		return sortedStrings(v)
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			list = append(list, fmt.Sprintf("%v", normalizeValue(item)))
+		}
+		return sortedStrings(list)
+	case map[string]string:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = item
+		}
+		return result
+	case map[string]interface{}:
+		return v
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[fmt.Sprintf("%v", key)] = item
+		}
+		return result
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// durationsEqual treats "1h" and "3600" as the same value
+func durationsEqual(left string, right string) bool {
+	leftSeconds, ok := durationSeconds(left)
+	if !ok {
+		return false
+	}
+	rightSeconds, ok := durationSeconds(right)
+	if !ok {
+		return false
+	}
+	return leftSeconds == rightSeconds
+}
+
+func durationSeconds(value string) (int64, bool) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return seconds, true
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, false
+	}
+	return int64(duration.Seconds()), true
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	list := strings.Split(value, ",")
+	for i, item := range list {
+		list[i] = strings.TrimSpace(item)
+	}
+	return sortedStrings(list)
+}
+
+func sortedStrings(in []string) []string {
+	out := make([]string, len(in))
+	copy(out, in)
+	sort.Strings(out)
+	return out
+}
+
+// typedValuesEqual compares values keeping their types: "1" and 1 or "true" and true are different values.
+// Numbers are compared by value since Vault returns them as json.Number.
+func typedValuesEqual(desired interface{}, current interface{}) bool {
+	desired = toJSONValue(desired)
+	switch d := desired.(type) {
+	case nil:
+		return current == nil
+	case string:
+		c, ok := current.(string)
+		return ok && d == c
+	case bool:
+		c, ok := current.(bool)
+		return ok && d == c
+	case int, int64, float64, json.Number:
+		if _, ok := current.(string); ok {
+			return false
+		}
+		return numberEqual(d, current)
+	case []interface{}:
+		c, ok := current.([]interface{})
+		if !ok || len(d) != len(c) {
+			return false
+		}
+		for i := range d {
+			if !typedValuesEqual(d[i], c[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		c, ok := current.(map[string]interface{})
+		if !ok || len(d) != len(c) {
+			return false
+		}
+		for key, value := range d {
+			currentValue, ok := c[key]
+			if !ok || !typedValuesEqual(value, currentValue) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(desired, current)
+}
+
+func numberEqual(left interface{}, right interface{}) bool {
+	leftNumber, err := strconv.ParseFloat(fmt.Sprintf("%v", left), 64)
+	if err != nil {
+		return false
+	}
+	rightNumber, err := strconv.ParseFloat(fmt.Sprintf("%v", right), 64)
+	if err != nil {
+		return false
+	}
+	return leftNumber == rightNumber
+}
@@ -0,0 +1,136 @@
+// +build integration
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiffProperties(t *testing.T) {
+	desired := map[string]interface{}{
+		"ttl":      "1h",
+		"policies": "default, admin",
+		"port":     8080,
+		"password": "secret",
+	}
+	current := map[string]interface{}{
+		"ttl":      json.Number("3600"),
+		"policies": []interface{}{"admin", "default"},
+		"port":     json.Number("8081"),
+	}
+
+	Convey("Diff properties", t, func() {
+
+		Convey("missing keys are changed", func() {
+			So(diffProperties(desired, current, false), ShouldResemble, []string{"password", "port"})
+		})
+
+		Convey("missing keys are ignored", func() {
+			So(diffProperties(desired, current, true), ShouldResemble, []string{"port"})
+		})
+	})
+}
+
+func TestValuesEqual(t *testing.T) {
+
+	Convey("Compare values loosely", t, func() {
+
+		Convey("strings", func() {
+			So(valuesEqual("abc", "abc"), ShouldBeTrue)
+			So(valuesEqual("abc", "abd"), ShouldBeFalse)
+		})
+
+		Convey("durations and seconds", func() {
+			So(valuesEqual("1h", json.Number("3600")), ShouldBeTrue)
+			So(valuesEqual("30m", json.Number("3600")), ShouldBeFalse)
+			So(valuesEqual("90m", "1h30m"), ShouldBeTrue)
+			So(valuesEqual("60", 60), ShouldBeTrue)
+		})
+
+		Convey("comma strings and lists", func() {
+			So(valuesEqual("a, b", []interface{}{"b", "a"}), ShouldBeTrue)
+			So(valuesEqual([]string{"a", "b"}, "b,a"), ShouldBeTrue)
+			So(valuesEqual("a,b", []interface{}{"a"}), ShouldBeFalse)
+			So(valuesEqual([]interface{}{"b", "a"}, []string{"a", "b"}), ShouldBeTrue)
+			So(valuesEqual("", []interface{}{}), ShouldBeTrue)
+		})
+
+		Convey("scalars", func() {
+			So(valuesEqual(true, "true"), ShouldBeTrue)
+			So(valuesEqual(json.Number("5"), 5), ShouldBeTrue)
+			So(valuesEqual(json.Number("0.5"), 0.5), ShouldBeTrue)
+			So(valuesEqual(json.Number("5"), 6), ShouldBeFalse)
+			So(valuesEqual(nil, ""), ShouldBeTrue)
+		})
+
+		Convey("nested maps", func() {
+			So(valuesEqual(
+				map[interface{}]interface{}{"ttl": "1h", "tags": "a,b"},
+				map[string]interface{}{"ttl": json.Number("3600"), "tags": []interface{}{"a", "b"}},
+			), ShouldBeTrue)
+			So(valuesEqual(map[string]string{"a": "1"}, map[string]interface{}{"b": "1"}), ShouldBeFalse)
+			So(valuesEqual(
+				map[string]interface{}{"a": "1"},
+				map[string]interface{}{"a": "1", "b": "2"},
+			), ShouldBeFalse)
+			So(valuesEqual(map[string]interface{}{"a": "1"}, "a=1"), ShouldBeFalse)
+		})
+	})
+}
+
+func TestTypedValuesEqual(t *testing.T) {
+
+	Convey("Compare values with their types", t, func() {
+
+		Convey("scalars", func() {
+			So(typedValuesEqual("abc", "abc"), ShouldBeTrue)
+			So(typedValuesEqual("1", json.Number("1")), ShouldBeFalse)
+			So(typedValuesEqual(1, json.Number("1")), ShouldBeTrue)
+			So(typedValuesEqual(1.5, json.Number("1.5")), ShouldBeTrue)
+			So(typedValuesEqual(2, json.Number("1")), ShouldBeFalse)
+			So(typedValuesEqual(true, "true"), ShouldBeFalse)
+			So(typedValuesEqual(false, false), ShouldBeTrue)
+			So(typedValuesEqual(nil, nil), ShouldBeTrue)
+			So(typedValuesEqual(nil, ""), ShouldBeFalse)
+		})
+
+		Convey("lists", func() {
+			So(typedValuesEqual([]interface{}{"a", "b"}, []interface{}{"a", "b"}), ShouldBeTrue)
+			So(typedValuesEqual([]interface{}{"a", "b"}, []interface{}{"b", "a"}), ShouldBeFalse)
+			So(typedValuesEqual("a,b", []interface{}{"a", "b"}), ShouldBeFalse)
+		})
+
+		Convey("nested maps", func() {
+			So(typedValuesEqual(
+				map[interface{}]interface{}{"a": 1, "b": []interface{}{"x"}},
+				map[string]interface{}{"a": json.Number("1"), "b": []interface{}{"x"}},
+			), ShouldBeTrue)
+			So(typedValuesEqual(
+				map[string]interface{}{"a": map[string]interface{}{"b": "1"}},
+				map[string]interface{}{"a": map[string]interface{}{"b": json.Number("1")}},
+			), ShouldBeFalse)
+			So(typedValuesEqual(
+				map[string]interface{}{"a": 1},
+				map[string]interface{}{"b": json.Number("1")},
+			), ShouldBeFalse)
+		})
+	})
+}
@@ -18,36 +18,84 @@ package injest
 
 import (
 	"config2vault/log"
+	"errors"
+	"path"
+	"sort"
 	"strings"
 
 	vaultapi "github.com/hashicorp/vault/api"
 )
 
-func (vault *vaultClient) UpdateAppRoles(newAppRoles *[]appRoleProperties) error {
+const defaultAppRoleMount = "approle"
+
+func (vault *vaultClient) UpdateAppRoles(authBackends *[]authBackendInfo, newAppRoles *[]appRoleProperties) error {
 	log.Debug("Applying AppRoles")
 	if len(*newAppRoles) == 0 {
 		log.Info("No AppRoles to apply")
 	}
 
-	// TODO: this List fails if the backend is not mounted
-	currentRoles, err := vault.ListAppRoles()
+	// Roles of every declared AppRole backend are managed, even if it has no roles in the rules
+	appRoleBackends := map[string]authBackendInfo{}
+	managedRoles := map[string][]appRoleProperties{}
+	for _, backend := range *authBackends {
+		if backend.Type == "approle" {
+			appRoleBackends[backend.Path] = backend
+			managedRoles[backend.Path] = []appRoleProperties{}
+		}
+	}
+
+	for _, newAppRole := range *newAppRoles {
+		if newAppRole.Mount == "" {
+			newAppRole.Mount = defaultAppRoleMount
+		}
+		newAppRole.Mount = strings.Trim(newAppRole.Mount, "/")
+		if _, ok := appRoleBackends[newAppRole.Mount]; !ok {
+			log.Errorf("Auth backend '%s' of the AppRole '%s' is not declared in 'auth' with type 'approle'", newAppRole.Mount, newAppRole.Name)
+			return errors.New("AppRole auth backend is not mounted: " + newAppRole.Mount)
+		}
+		managedRoles[newAppRole.Mount] = append(managedRoles[newAppRole.Mount], newAppRole)
+	}
+
+	mountPaths := make([]string, 0, len(managedRoles))
+	for mountPath := range managedRoles {
+		mountPaths = append(mountPaths, mountPath)
+	}
+	sort.Strings(mountPaths)
+
+	for _, mountPath := range mountPaths {
+		if err := vault.updateMountAppRoles(appRoleBackends[mountPath], managedRoles[mountPath]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateMountAppRoles reconciles the roles of a single AppRole backend and removes its runaway roles
+func (vault *vaultClient) updateMountAppRoles(backend authBackendInfo, newAppRoles []appRoleProperties) error {
+	currentRoles, err := vault.ListAppRoles(backend.Path)
 	if err != nil {
 		return err
 	}
 
-	for _, newAppRole := range *newAppRoles {
+	for _, newAppRole := range newAppRoles {
+		rolePath := path.Join("auth", backend.Path, "role", newAppRole.Name)
 		needRoleUpdate := true // Will create the role if not found
-		if currentAppRole, ok, err := vault.getCachedAppRole(newAppRole.Name, currentRoles); ok && err == nil {
-			if err != nil {
-				// Error retreiving AppRole
-				return err
-			}
+		changed := []string{}
+		currentAppRole, ok, err := vault.getCachedAppRole(backend.Path, newAppRole.Name, currentRoles)
+		if err != nil {
+			// Error retreiving AppRole
+			return err
+		}
+		if ok {
 			// Found app role and will update only if they are not equal
-			if currentAppRole.isEqual(&newAppRole) {
+			changed = currentAppRole.diff(&newAppRole)
+			if len(changed) == 0 {
 				log.Debug("Roles identical. Skipping ...")
 				needRoleUpdate = false
+				vault.summary.record("approle", rolePath, actionUnchanged)
 			} else {
-				log.Warningf("Roles '%s' are NOT identical. Updating ...", currentAppRole.Name)
+				log.Warningf("Roles '%s' are NOT identical in %v. Updating ...", currentAppRole.Name, changed)
 				needRoleUpdate = true
 			}
 		}
@@ -57,6 +105,20 @@ func (vault *vaultClient) UpdateAppRoles(newAppRoles *[]appRoleProperties) error
 				// Failed to update app role
 				return err
 			}
+			if ok {
+				vault.summary.record("approle", rolePath, actionUpdated, changed...)
+			} else {
+				vault.summary.record("approle", rolePath, actionCreated)
+			}
+		}
+		if err := vault.pinAppRoleID(&newAppRole); err != nil {
+			return err
+		}
+		// Destroying the unexpected SecretIDs is opt-in
+		if newAppRole.SecretIdAudit != nil && newAppRole.SecretIdAudit.Prune {
+			if err := vault.AuditSecretIds(&newAppRole, true); err != nil {
+				return err
+			}
 		}
 		delete(currentRoles, newAppRole.Name)
 	}
@@ -66,41 +128,113 @@ func (vault *vaultClient) UpdateAppRoles(newAppRoles *[]appRoleProperties) error
 
 		// Runaway roles
 		for oldAppRoleKey, _ := range currentRoles {
-			_, err := vault.DeleteAppRole(oldAppRoleKey)
+			rolePath := path.Join("auth", backend.Path, "role", oldAppRoleKey)
+			if backend.Prune == authPruneNone {
+				log.Warning("Found runaway app role: " + rolePath)
+				vault.summary.record("approle", rolePath, actionSkipped)
+				continue
+			}
+			_, err := vault.DeleteAppRole(backend.Path, oldAppRoleKey)
 			if err != nil {
 				// Failed to delete app role
 				return err
 			}
+			vault.summary.record("approle", rolePath, actionDeleted)
 		}
 	}
 
 	return nil
 }
 
-func (roleA *appRoleProperties) isEqual(roleB *appRoleProperties) bool {
-	if roleA.SecretIdTtl != roleB.SecretIdTtl {
-		return false
+// toData returns the properties of the role as they are written to Vault. The properties of the older Vault
+// versions are always set, the token parameters of the newer versions only when declared.
+func (appRole *appRoleProperties) toData() map[string]interface{} {
+	bindSecretId := true
+	if appRole.BindSecretId != nil {
+		bindSecretId = *appRole.BindSecretId
+	}
+	data := map[string]interface{}{
+		"policies":           strings.Join(appRole.Policies, ","),
+		"secret_id_ttl":      durationOrZero(appRole.SecretIdTtl),
+		"token_ttl":          durationOrZero(appRole.TokenTtl),
+		"token_max_ttl":      durationOrZero(appRole.TokenMaxTtl),
+		"secret_id_num_uses": appRole.SecretIdNumUses,
+		"bind_secret_id":     bindSecretId,
+		"period":             durationOrZero(appRole.Period),
+		"bound_cidr_list":    strings.Join(appRole.BoundCidrList, ","),
+	}
+	// The newer properties replace the deprecated ones
+	if len(appRole.TokenPolicies) > 0 {
+		delete(data, "policies")
+		data["token_policies"] = appRole.TokenPolicies
 	}
-	if roleA.TokenTtl != roleB.TokenTtl {
-		return false
+	if len(appRole.SecretIdBoundCidrs) > 0 {
+		delete(data, "bound_cidr_list")
+		data["secret_id_bound_cidrs"] = []string(appRole.SecretIdBoundCidrs)
 	}
-	if roleA.TokenMaxTtl != roleB.TokenMaxTtl {
-		return false
+	if len(appRole.TokenBoundCidrs) > 0 {
+		data["token_bound_cidrs"] = []string(appRole.TokenBoundCidrs)
 	}
-	if roleA.SecretIdNumUses != roleB.SecretIdNumUses {
-		return false
+	if appRole.TokenNumUses > 0 {
+		data["token_num_uses"] = appRole.TokenNumUses
 	}
-	if roleA.BindSecretId != roleB.BindSecretId {
-		return false
+	if appRole.TokenType != "" {
+		data["token_type"] = appRole.TokenType
 	}
-	if roleA.Period != roleB.Period {
-		return false
+	if appRole.TokenExplicitMaxTtl != "" {
+		data["token_explicit_max_ttl"] = appRole.TokenExplicitMaxTtl
 	}
-	if roleA.BoundCidrList != roleB.BoundCidrList {
-		return false
+	if appRole.TokenNoDefaultPolicy {
+		data["token_no_default_policy"] = true
 	}
+	if appRole.LocalSecretIds {
+		data["local_secret_ids"] = true
+	}
+	return data
+}
 
-	return areEqual(roleA.Policies, roleB.Policies, []string{"default"})
+// diff returns the sorted list of properties of the current role that differ from the desired role
+func (current *appRoleProperties) diff(desired *appRoleProperties) []string {
+	desiredData := desired.toData()
+	currentData := current.toData()
+
+	// Vault adds the 'default' policy on its own
+	changed := []string{}
+	if _, ok := desiredData["policies"]; ok && !areEqual(desired.Policies, current.Policies, []string{"default", ""}) {
+		changed = append(changed, "policies")
+	}
+	if _, ok := desiredData["token_policies"]; ok && !areEqual(desired.TokenPolicies, current.TokenPolicies, []string{"default"}) {
+		changed = append(changed, "token_policies")
+	}
+	delete(desiredData, "policies")
+	delete(desiredData, "token_policies")
+
+	// Newer Vault versions return the deprecated 'bound_cidr_list' as 'secret_id_bound_cidrs'
+	for _, data := range []map[string]interface{}{desiredData, currentData} {
+		delete(data, "bound_cidr_list")
+		delete(data, "secret_id_bound_cidrs")
+	}
+	desiredData["secret_id_bound_cidrs"] = desired.secretIdBoundCidrs()
+	currentData["secret_id_bound_cidrs"] = current.secretIdBoundCidrs()
+
+	changed = append(changed, diffProperties(desiredData, currentData, false)...)
+	sort.Strings(changed)
+	return changed
+}
+
+// secretIdBoundCidrs returns the CIDRs the SecretIDs of the role are bound to, declared with either property
+func (appRole *appRoleProperties) secretIdBoundCidrs() []string {
+	if len(appRole.SecretIdBoundCidrs) > 0 {
+		return []string(appRole.SecretIdBoundCidrs)
+	}
+	return []string(appRole.BoundCidrList)
+}
+
+func durationOrZero(value string) string {
+	if value == "" {
+		return "0"
+	}
+	return value
 }
 
 func areEqual(left []string, right []string, ignore []string) bool {
@@ -129,12 +263,12 @@ func areEqual(left []string, right []string, ignore []string) bool {
 	return true
 }
 
-func (vault *vaultClient) ListAppRoles() (roles map[string]*appRoleProperties, err error) {
+func (vault *vaultClient) ListAppRoles(mount string) (roles map[string]*appRoleProperties, err error) {
 	roles = make(map[string]*appRoleProperties)
-	result, err := vault.Client.Logical().List("auth/approle/role")
+	result, err := vault.Client.Logical().List(path.Join("auth", mount, "role"))
 	if err != nil {
-		log.Errorf("Failed to list app roles. %#v", err)
-		//return roles, err
+		log.Errorf("Failed to list app roles of '%s'. %#v", mount, err)
+		return roles, err
 	}
 	if result == nil {
 		log.Debugf("No roles found.")
@@ -151,13 +285,13 @@ func (vault *vaultClient) ListAppRoles() (roles map[string]*appRoleProperties, e
 	return roles, nil
 }
 
-func (vault *vaultClient) getCachedAppRole(roleKey string, roles map[string]*appRoleProperties) (*appRoleProperties, bool, error) {
+func (vault *vaultClient) getCachedAppRole(mount string, roleKey string, roles map[string]*appRoleProperties) (*appRoleProperties, bool, error) {
 	appRole := roles[roleKey]
 	if appRole != nil {
 		return appRole, true, nil
 	}
 
-	roleData, err := vault.GetAppRole(roleKey)
+	roleData, err := vault.GetAppRole(mount, roleKey)
 	if err != nil || roleData == nil {
 		return nil, false, err
 	}
@@ -168,36 +302,16 @@ func (vault *vaultClient) getCachedAppRole(roleKey string, roles map[string]*app
 }
 
 func (vault *vaultClient) SetAppRole(appRole *appRoleProperties) error {
-	data := map[string]interface{}{}
-	if appRole.SecretIdTtl != "" {
-		data["secret_id_ttl"] = appRole.SecretIdTtl
-	}
-	if appRole.TokenTtl != "" {
-		data["token_ttl"] = appRole.TokenTtl
-	}
-	if appRole.TokenMaxTtl != "" {
-		data["token_max_ttl"] = appRole.TokenMaxTtl
-	}
-	data["bind_secret_id"] = appRole.BindSecretId
-	if appRole.Period != "" {
-		data["period"] = appRole.Period
-	}
-	if appRole.BoundCidrList != "" {
-		data["bound_cidr_list"] = appRole.BoundCidrList
+	mount := appRole.Mount
+	if mount == "" {
+		mount = defaultAppRoleMount
 	}
-	if appRole.SecretIdNumUses > 0 {
-		data["secret_id_num_uses"] = appRole.SecretIdNumUses
-	}
-	if len(appRole.Policies) > 0 {
-		data["policies"] = strings.Join(appRole.Policies, ",")
-	}
-
-	_, err := vault.Client.Logical().Write("auth/approle/role/"+appRole.Name, data)
+	_, err := vault.Client.Logical().Write(path.Join("auth", mount, "role", appRole.Name), appRole.toData())
 	if err != nil {
 		log.Fatalf("Failed to create app role '%s'. %#v", appRole.Name, err)
 		return err
 	}
-	info, err := vault.Client.Logical().Read("auth/approle/role/" + appRole.Name + "/role-id")
+	info, err := vault.Client.Logical().Read(path.Join("auth", mount, "role", appRole.Name, "role-id"))
 	roleID := ""
 	if info != nil && info.Data != nil {
 		roleID = getStringFromMap(&info.Data, "role_id", "")
@@ -207,9 +321,36 @@ func (vault *vaultClient) SetAppRole(appRole *appRoleProperties) error {
 	return nil
 }
 
-func (vault *vaultClient) GetAppRole(roleKey string) (*appRoleProperties, error) {
+// pinAppRoleID sets the RoleID declared in the rules, so it stays the same across cluster rebuilds
+func (vault *vaultClient) pinAppRoleID(appRole *appRoleProperties) error {
+	if appRole.RoleId == "" {
+		return nil
+	}
+
+	roleID, err := vault.GetAppRoleID(appRole.Mount, appRole.Name)
+	if err != nil {
+		return err
+	}
+	if roleID == appRole.RoleId {
+		return nil
+	}
+
+	rolePath := path.Join("auth", appRole.Mount, "role", appRole.Name)
+	log.Infof("Pinning RoleID of the app role '%s'", rolePath)
+	_, err = vault.Client.Logical().Write(rolePath+"/role-id", map[string]interface{}{
+		"role_id": appRole.RoleId,
+	})
+	if err != nil {
+		log.Errorf("Failed to set RoleID of the app role '%s'. %v", rolePath, err)
+		return err
+	}
+	vault.summary.record("approle", rolePath, actionUpdated, "role_id")
+	return nil
+}
+
+func (vault *vaultClient) GetAppRole(mount string, roleKey string) (*appRoleProperties, error) {
 	log.Debugf("Retreiving policy for role '%s'", roleKey)
-	role, err := vault.Client.Logical().Read("auth/approle/role/" + roleKey)
+	role, err := vault.Client.Logical().Read(path.Join("auth", mount, "role", roleKey))
 	if err != nil {
 		log.Errorf("Failed to read App Role '%s'. %#v", roleKey, err)
 		return nil, err
@@ -219,24 +360,48 @@ func (vault *vaultClient) GetAppRole(roleKey string) (*appRoleProperties, error)
 	}
 	log.Debugf("Role: %#v", *role)
 
+	// Newer Vault versions return the deprecated properties only when they are set
+	policies := getStringListFromMap(&role.Data, "policies")
+	if _, ok := role.Data["policies"]; !ok {
+		policies = getStringListFromMap(&role.Data, "token_policies")
+	}
+	period := getStringFromMap(&role.Data, "period", "")
+	if period == "" {
+		period = getStringFromMap(&role.Data, "token_period", "0")
+	}
+	boundCidrList := getStringListFromMap(&role.Data, "bound_cidr_list")
+	if _, ok := role.Data["bound_cidr_list"]; !ok {
+		boundCidrList = getStringListFromMap(&role.Data, "secret_id_bound_cidrs")
+	}
+	bindSecretId := getBoolFromMap(&role.Data, "bind_secret_id", true)
+
 	roleData := appRoleProperties{
-		Name:            roleKey,
-		SecretIdNumUses: getIntFromMap(&role.Data, "secret_id_num_uses", -1),
-		SecretIdTtl:     getStringFromMap(&role.Data, "secret_id_ttl", "-1"),
-		TokenMaxTtl:     getStringFromMap(&role.Data, "token_max_ttl", "-1"),
-		TokenTtl:        getStringFromMap(&role.Data, "token_ttl", "-1"),
-		BindSecretId:    getBoolFromMap(&role.Data, "bind_secret_id", true),
-		Period:          getStringFromMap(&role.Data, "period", "-1"),
-		BoundCidrList:   getStringFromMap(&role.Data, "bound_cidr_list", ""),
-		Policies:        getStringArrayFromMap(&role.Data, "policies", []string{}),
+		Name:                 roleKey,
+		Mount:                mount,
+		SecretIdNumUses:      getIntFromMap(&role.Data, "secret_id_num_uses", 0),
+		SecretIdTtl:          getStringFromMap(&role.Data, "secret_id_ttl", "0"),
+		TokenMaxTtl:          getStringFromMap(&role.Data, "token_max_ttl", "0"),
+		TokenTtl:             getStringFromMap(&role.Data, "token_ttl", "0"),
+		BindSecretId:         &bindSecretId,
+		Period:               period,
+		BoundCidrList:        boundCidrList,
+		Policies:             policies,
+		TokenPolicies:        getStringListFromMap(&role.Data, "token_policies"),
+		TokenBoundCidrs:      getStringListFromMap(&role.Data, "token_bound_cidrs"),
+		SecretIdBoundCidrs:   getStringListFromMap(&role.Data, "secret_id_bound_cidrs"),
+		TokenNumUses:         getIntFromMap(&role.Data, "token_num_uses", 0),
+		TokenType:            getStringFromMap(&role.Data, "token_type", ""),
+		TokenExplicitMaxTtl:  getStringFromMap(&role.Data, "token_explicit_max_ttl", ""),
+		TokenNoDefaultPolicy: getBoolFromMap(&role.Data, "token_no_default_policy", false),
+		LocalSecretIds:       getBoolFromMap(&role.Data, "local_secret_ids", false),
 	}
 
 	return &roleData, nil
 }
 
-func (vault *vaultClient) GetAppRoleID(roleKey string) (string, error) {
+func (vault *vaultClient) GetAppRoleID(mount string, roleKey string) (string, error) {
 
-	info, err := vault.Client.Logical().Read("auth/approle/role/" + roleKey + "/role-id")
+	info, err := vault.Client.Logical().Read(path.Join("auth", mount, "role", roleKey, "role-id"))
 	if err != nil {
 		log.Error("Failed to get RoleID for Role: " + roleKey)
 		return "", err
@@ -250,18 +415,18 @@ func (vault *vaultClient) GetAppRoleID(roleKey string) (string, error) {
 	return roleID, nil
 }
 
-func (vault *vaultClient) DeleteAppRole(roleKey string) (bool, error) {
+func (vault *vaultClient) DeleteAppRole(mount string, roleKey string) (bool, error) {
 	log.Debugf("Deleting app role: %s", roleKey)
-	_, err := vault.Client.Logical().Delete("auth/approle/role/" + roleKey)
+	_, err := vault.Client.Logical().Delete(path.Join("auth", mount, "role", roleKey))
 	if err != nil {
-		log.Error("Failed to get RoleID for Role: " + roleKey)
+		log.Error("Failed to delete Role: " + roleKey)
 		return false, err
 	}
 	return true, nil
 }
 
-func (vault *vaultClient) GetAppRoleSecretID(roleKey string) (string, error) {
-	secret, err := vault.Client.Logical().Write("auth/approle/role/"+roleKey+"/secret-id", map[string]interface{}{})
+func (vault *vaultClient) GetAppRoleSecretID(mount string, roleKey string) (string, error) {
+	secret, err := vault.Client.Logical().Write(path.Join("auth", mount, "role", roleKey, "secret-id"), map[string]interface{}{})
 	if err != nil {
 		log.Error("Failed to get SecretID for Role: " + roleKey)
 		return "", err
@@ -270,12 +435,12 @@ func (vault *vaultClient) GetAppRoleSecretID(roleKey string) (string, error) {
 	return secretID, nil
 }
 
-func (vault *vaultClient) LoginAppRole(roleID string, secretID string) (*vaultapi.SecretAuth, error) {
+func (vault *vaultClient) LoginAppRole(mount string, roleID string, secretID string) (*vaultapi.SecretAuth, error) {
 	data := map[string]interface{}{
 		"role_id":   roleID,
 		"secret_id": secretID,
 	}
-	secret, err := vault.Client.Logical().Write("auth/approle/login", data)
+	secret, err := vault.Client.Logical().Write(path.Join("auth", mount, "login"), data)
 	if err != nil {
 		log.Error("Failed to Login with RoleID: " + roleID)
 		return nil, err
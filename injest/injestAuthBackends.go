@@ -20,6 +20,7 @@ import (
 	"config2vault/log"
 	"errors"
 	"fmt"
+	"strings"
 
 	vaultapi "github.com/hashicorp/vault/api"
 )
@@ -57,15 +58,13 @@ func (vault *vaultClient) UpdateAuthBackends(authMounts *[]authBackendInfo) erro
 			}
 
 			// Reconverge config for the existing mounts
-			if err := vault.ConfigureAuthBackend(&authBackend); err != nil {
+			if err := vault.ConfigureAuthBackend(&authBackend, false); err != nil {
 				return err
 			}
 
 			// Similar mount is present in the system
 			log.Infof("Skipping '%s' auth mount", authBackend.Type)
 			delete(current_auth_mounts, authBackend.Path)
-
-			// TODO: reapply configuration
 			continue
 		}
 
@@ -77,7 +76,7 @@ func (vault *vaultClient) UpdateAuthBackends(authMounts *[]authBackendInfo) erro
 			return err
 		}
 
-		if err := vault.ConfigureAuthBackend(&authBackend); err != nil {
+		if err := vault.ConfigureAuthBackend(&authBackend, true); err != nil {
 			return err
 		}
 	}
@@ -114,9 +113,54 @@ func (vault *vaultClient) ListAuthBackends() (*map[string]authBackendInfo, error
 		vaultAuthMounts[oldMount.Path] = oldMount
 	}
 
+	accessors, err := vault.ListAuthAccessors()
+	if err != nil {
+		return nil, err
+	}
+	for authPath, accessor := range accessors {
+		if authMount, ok := vaultAuthMounts[authPath]; ok {
+			authMount.Accessor = accessor
+			vaultAuthMounts[authPath] = authMount
+		}
+	}
+
 	return &vaultAuthMounts, nil
 }
 
+// ListAuthAccessors returns the accessors of the auth backends keyed by the mount path
+func (vault *vaultClient) ListAuthAccessors() (map[string]string, error) {
+	r := vault.Client.NewRequest("GET", "/v1/sys/auth")
+	resp, err := vault.Client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		log.Errorf("Can't get Vault auth mounts. %v", err)
+		return nil, err
+	}
+
+	var result map[string]interface{}
+	if err := resp.DecodeJSON(&result); err != nil {
+		log.Errorf("Can't parse Vault auth mounts. %v", err)
+		return nil, err
+	}
+	// Newer versions of Vault wrap the mounts into the 'data' section
+	if data, ok := result["data"].(map[string]interface{}); ok {
+		result = data
+	}
+
+	accessors := map[string]string{}
+	for authPath, authMount := range result {
+		authData, ok := authMount.(map[string]interface{})
+		if !ok || !strings.HasSuffix(authPath, "/") {
+			continue
+		}
+		accessors[TrimSuffix(authPath, "/")] = getStringFromMap(&authData, "accessor", "")
+	}
+
+	return accessors, nil
+}
+
 func (vault *vaultClient) EnableAuthBackend(authBackend *authBackendInfo) error {
 
 	log.Infof("Adding new auth backend of type '%s' at path '%s'.", authBackend.Type, authBackend.Path)
@@ -157,24 +201,26 @@ func (vault *vaultClient) DisableAuthBackend(authBackendPath string) error {
 	return nil
 }
 
-func (vault *vaultClient) ConfigureAuthBackend(authBackend *authBackendInfo) error {
+func (vault *vaultClient) ConfigureAuthBackend(authBackend *authBackendInfo, isNewBackend bool) error {
 	log.Infof("Configuring '%s' auth backend", authBackend.Path)
-	// TODO: read existing config, compare and apply only if not equal
 	for _, props := range authBackend.Config {
 		path, ok := props["path"]
 		if !ok {
 			path = "config"
 		}
-		properties := getStringMapInterfaceFromMap(&props, "properties", nil)
-		if properties == nil {
+		properties, ok := getPropertyBag(props["properties"])
+		if !ok {
 			log.Fatalf("Configuration section '%s' present but no properties can be found", authBackend.Path)
 			return errors.New("Can't have auth config section without properties")
 		}
+		data, err := resolveSecretProperties(properties)
+		if err != nil {
+			return errors.New("Failed to configure Auth Backend: " + authBackend.Path)
+		}
 
 		configPath := fmt.Sprintf("auth/%s/%s", authBackend.Path, path)
-		log.Debugf("Writing auth backend '%s' properties to path: %s", authBackend.Path, configPath)
-		if _, err := vault.Client.Logical().Write(configPath, *properties); err != nil {
-			log.Errorf("Failed to write properties to path '%s': %v", configPath, err)
+		log.Debugf("Reconciling auth backend '%s' properties at path: %s", authBackend.Path, configPath)
+		if err := vault.reconcileConfigPath("auth config", configPath, data, getWritePolicy(props, writePolicyAlways), isNewBackend); err != nil {
 			return errors.New("Failed to configure Auth Backend: " + authBackend.Path)
 		}
 	}
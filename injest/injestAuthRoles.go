@@ -0,0 +1,195 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+)
+
+// authRoleCollections lists the sub-collections of the auth backend types. The first one is the default.
+var authRoleCollections = map[string][]string{
+	"kubernetes": []string{"role"},
+	"jwt":        []string{"role"},
+	"oidc":       []string{"role"},
+	"cert":       []string{"certs"},
+	"ldap":       []string{"groups", "users"},
+	"github":     []string{"map/teams", "map/users"},
+}
+
+// UpdateAuthRoles reconciles the sub-collections of the auth backends. Every collection of the declared backends
+// is managed, even if it has no roles in the rules, and its undeclared entries are removed unless the backend has
+// 'prune: none'. The entries written by the 'config' sections of the backend are left alone.
+func (vault *vaultClient) UpdateAuthRoles(authBackends *[]authBackendInfo, newAuthRoles *[]authRole) error {
+	log.Debug("Applying Auth roles")
+	if len(*newAuthRoles) == 0 {
+		log.Info("No Auth roles to apply")
+	}
+
+	backends := map[string]authBackendInfo{}
+	managedRoles := map[string][]authRole{}
+	collectionBackends := map[string]authBackendInfo{}
+	configuredPaths := map[string]bool{}
+	for _, backend := range *authBackends {
+		backends[backend.Path] = backend
+		for _, collection := range authRoleCollections[backend.Type] {
+			collectionPath := path.Join("auth", backend.Path, collection)
+			managedRoles[collectionPath] = []authRole{}
+			collectionBackends[collectionPath] = backend
+		}
+		for _, cfg := range backend.Config {
+			if configPath := getStringFromMap(&cfg, "path", ""); configPath != "" {
+				configuredPaths[path.Join("auth", backend.Path, configPath)] = true
+			}
+		}
+	}
+
+	for _, newRole := range *newAuthRoles {
+		newRole.Mount = strings.Trim(newRole.Mount, "/")
+		backend, ok := backends[newRole.Mount]
+		if !ok {
+			log.Errorf("Auth backend '%s' of the role '%s' is not declared in 'auth'", newRole.Mount, newRole.Name)
+			return errors.New("Auth backend is not mounted: " + newRole.Mount)
+		}
+		collections, ok := authRoleCollections[backend.Type]
+		if !ok {
+			log.Errorf("Auth backend '%s' of type '%s' has no roles", newRole.Mount, backend.Type)
+			return errors.New("Unsupported auth roles of type " + backend.Type)
+		}
+		if newRole.Collection == "" {
+			newRole.Collection = collections[0]
+		}
+		newRole.Collection = strings.Trim(newRole.Collection, "/")
+		known := false
+		for _, collection := range collections {
+			known = known || collection == newRole.Collection
+		}
+		if !known {
+			log.Errorf("Auth backend '%s' of type '%s' has no '%s' collection. Expected one of %v", newRole.Mount, backend.Type, newRole.Collection, collections)
+			return errors.New("Unknown auth roles collection " + newRole.Collection)
+		}
+
+		collectionPath := path.Join("auth", newRole.Mount, newRole.Collection)
+		managedRoles[collectionPath] = append(managedRoles[collectionPath], newRole)
+	}
+
+	collectionPaths := make([]string, 0, len(managedRoles))
+	for collectionPath := range managedRoles {
+		collectionPaths = append(collectionPaths, collectionPath)
+	}
+	sort.Strings(collectionPaths)
+
+	for _, collectionPath := range collectionPaths {
+		if err := vault.updateAuthRoleCollection(collectionBackends[collectionPath], collectionPath, managedRoles[collectionPath], configuredPaths); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateAuthRoleCollection reconciles the entries of a single sub-collection and removes its runaway entries.
+// Vault doesn't return the write-only properties (ex: tokens), so only the properties it returns are compared.
+func (vault *vaultClient) updateAuthRoleCollection(backend authBackendInfo, collectionPath string, newRoles []authRole, configuredPaths map[string]bool) error {
+	currentRoles, err := vault.ListAuthRoles(collectionPath)
+	if err != nil {
+		return err
+	}
+
+	for _, newRole := range newRoles {
+		rolePath := path.Join(collectionPath, newRole.Name)
+		data, err := resolveProperties(newRole.Properties)
+		if err != nil {
+			return errors.New("Failed to load properties of the auth role " + rolePath)
+		}
+
+		current, err := vault.Client.Logical().Read(rolePath)
+		if err != nil {
+			log.Errorf("Failed to read auth role '%s'. %v", rolePath, err)
+			return err
+		}
+
+		changed := []string{}
+		if current != nil {
+			changed = diffProperties(data, current.Data, true)
+			if len(changed) == 0 {
+				log.Debugf("Auth role '%s' is identical. Skipping ...", rolePath)
+				vault.summary.record("auth role", rolePath, actionUnchanged)
+				delete(currentRoles, newRole.Name)
+				continue
+			}
+			log.Warningf("Auth role '%s' is NOT identical in %v. Updating ...", rolePath, changed)
+		}
+
+		if _, err := vault.Client.Logical().Write(rolePath, data); err != nil {
+			log.Errorf("Failed to set auth role '%s'. %v", rolePath, err)
+			return errors.New("Failed to set auth role " + rolePath)
+		}
+		if current != nil {
+			vault.summary.record("auth role", rolePath, actionUpdated, changed...)
+		} else {
+			vault.summary.record("auth role", rolePath, actionCreated)
+		}
+		delete(currentRoles, newRole.Name)
+	}
+
+	// Runaway roles
+	runaway := make([]string, 0, len(currentRoles))
+	for name := range currentRoles {
+		if !configuredPaths[path.Join(collectionPath, name)] {
+			runaway = append(runaway, name)
+		}
+	}
+	sort.Strings(runaway)
+	for _, name := range runaway {
+		rolePath := path.Join(collectionPath, name)
+		if backend.Prune == authPruneNone {
+			log.Infof("Keeping undeclared auth role: %s", rolePath)
+			vault.summary.record("auth role", rolePath, actionSkipped)
+			continue
+		}
+		log.Warningf("Found runaway auth role: %s. Removing ...", rolePath)
+		if _, err := vault.Client.Logical().Delete(rolePath); err != nil {
+			log.Errorf("Failed to delete auth role '%s'. %v", rolePath, err)
+			return errors.New("Failed to delete auth role " + rolePath)
+		}
+		vault.summary.record("auth role", rolePath, actionDeleted)
+	}
+
+	return nil
+}
+
+func (vault *vaultClient) ListAuthRoles(collectionPath string) (map[string]bool, error) {
+	roles := map[string]bool{}
+	result, err := vault.Client.Logical().List(collectionPath)
+	if err != nil {
+		log.Errorf("Failed to list auth roles at '%s'. %v", collectionPath, err)
+		return roles, err
+	}
+	if result == nil {
+		return roles, nil
+	}
+
+	for _, name := range getStringArrayFromMap(&result.Data, "keys", []string{}) {
+		roles[name] = true
+	}
+	log.Infof("Found %d Auth roles at '%s'", len(roles), collectionPath)
+	return roles, nil
+}
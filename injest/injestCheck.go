@@ -0,0 +1,63 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"errors"
+	"strings"
+)
+
+// Check validates the rules and audits the credentials issued by Vault against them without changing anything.
+// Returns the number of findings.
+func Check(config *vaultConfig) (int, error) {
+	vault, err := Reconnect()
+	if err != nil {
+		return 0, errors.New("Can't create Vault client")
+	}
+
+	return checkConfig(vault, config)
+}
+
+func checkConfig(vault *vaultClient, conf *vaultConfig) (int, error) {
+	vault.summary = runSummary{}
+	defer vault.summary.report()
+
+	// ### Mounts and roles
+	if err := validateMounts(conf); err != nil {
+		return 0, err
+	}
+
+	// ### SecretIDs of the AppRoles
+	for _, appRole := range conf.AppRoles {
+		if appRole.Mount == "" {
+			appRole.Mount = defaultAppRoleMount
+		}
+		appRole.Mount = strings.Trim(appRole.Mount, "/")
+		if err := vault.AuditSecretIds(&appRole, false); err != nil {
+			return 0, errors.New("Failed to audit SecretIDs")
+		}
+	}
+
+	// ### Tokens
+	if err := vault.AuditTokens(&conf.Policies, false); err != nil {
+		return 0, errors.New("Failed to audit tokens")
+	}
+
+	log.Infof("Found %d unexpected credentials", len(vault.summary.Findings))
+	return len(vault.summary.Findings), nil
+}
@@ -20,7 +20,6 @@ import (
 	"config2vault/config"
 	"config2vault/log"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -36,8 +35,9 @@ import (
 )
 
 type vaultClient struct {
-	Token  string
-	Client *vaultapi.Client
+	Token   string
+	Client  *vaultapi.Client
+	summary runSummary
 }
 
 type mountInfo struct {
@@ -48,7 +48,14 @@ type mountInfo struct {
 	MaxLeaseTTL        string `yaml:"max_lease_ttl,omitempty"`
 	PolicyBase64Encode bool   `yaml:"policy_base64_encode,omitempty"`
 	//ForceNoCache       bool                     `yaml:"force_no_cache,omitempty"`
-	Config []map[string]interface{} `yaml:"config,omitempty"`
+	Config  []map[string]interface{} `yaml:"config,omitempty"`
+	Options map[string]string        `yaml:"options,omitempty"`
+	// How to prune unmanaged secrets of a KV mount (delete, destroy or none) or the runaway roles,
+	// connections, etc. of the other mounts (delete or none)
+	Prune string `yaml:"prune,omitempty"`
+	// The sections of the mount that are specific to its engine (ex: 'connections' of the database mounts).
+	// The engine handler decodes them with decodeMountSection.
+	Sections map[string]interface{} `yaml:",inline"`
 }
 
 type propertyBag map[string]interface{}
@@ -61,20 +68,44 @@ type authBackendInfo struct {
 	DefaultLeaseTTL string                   `yaml:"default_lease_ttl,omitempty"`
 	MaxLeaseTTL     string                   `yaml:"max_lease_ttl,omitempty"`
 	Config          []map[string]interface{} `yaml:"config,omitempty"`
+	// What to do with the runaway users and roles of the backend: delete (default) or none
+	Prune string `yaml:"prune,omitempty"`
+	// Accessor of the existing backend. Read from Vault
+	Accessor string `yaml:"-"`
 }
 
 type rolePolicy struct {
-	Name       string            `yaml:"name"`
-	Path       string            `yaml:"path"`
-	Properties map[string]string `yaml:"properties"`
+	Name string `yaml:"name"`
+	// Path of the mount
+	Path string `yaml:"path"`
+	// Sub-path of the mount that holds the roles. Defaults to the main role collection of the mount type
+	Collection string      `yaml:"collection,omitempty"`
+	Properties propertyBag `yaml:"properties"`
+}
+
+// authRole is an entry of a sub-collection of an auth backend: a kubernetes or jwt role, a trusted certificate,
+// an LDAP group or user mapping or a GitHub team mapping
+type authRole struct {
+	// Path of the auth backend
+	Mount string `yaml:"mount"`
+	// role, certs, groups, users or map/teams. Defaults to the only collection of the backend type
+	Collection string      `yaml:"collection,omitempty"`
+	Name       string      `yaml:"name"`
+	Properties propertyBag `yaml:"properties,omitempty"`
 }
 
 type userAccount struct {
-	Name     string   `yaml:"name"`
-	Password string   `yaml:"password,omitempty"`
-	Policies []string `yaml:"policies,omitempty"`
-	Ttl      string   `yaml:"ttl,omitempty"`
-	MaxTtl   string   `yaml:"max_ttl,omitempty"`
+	Name string `yaml:"name"`
+	// Userpass auth backend of the user. Defaults to 'userpass'
+	Mount    string `yaml:"mount,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// Password is generated when the user is created. Declared as 'password: {generate: ...}'
+	GeneratePassword *generateSpec `yaml:"-"`
+	// always (default) resets the password of the existing user on every run, set_once only for the new user
+	PasswordPolicy string   `yaml:"password_policy,omitempty"`
+	Policies       []string `yaml:"policies,omitempty"`
+	Ttl            string   `yaml:"ttl,omitempty"`
+	MaxTtl         string   `yaml:"max_ttl,omitempty"`
 }
 
 type policyDefiniton struct {
@@ -83,32 +114,104 @@ type policyDefiniton struct {
 }
 
 type appRoleProperties struct {
-	Name            string   `yaml:"name"`
+	Name string `yaml:"name"`
+	// AppRole auth backend of the role. Defaults to 'approle'
+	Mount           string   `yaml:"mount,omitempty"`
 	Policies        []string `yaml:"policies,omitempty"`
 	SecretIdTtl     string   `yaml:"secret_id_ttl,omitempty"`
 	TokenTtl        string   `yaml:"token_ttl,omitempty"`
 	TokenMaxTtl     string   `yaml:"token_max_ttl,omitempty"`
 	SecretIdNumUses int      `yaml:"secret_id_num_uses,omitempty"`
-	BindSecretId    bool     `yaml:"bind_secret_id,omitempty"`
-	Period          string   `yaml:"period,omitempty"`
-	BoundCidrList   string   `yaml:"bound_cidr_list,omitempty"`
+	// Defaults to true
+	BindSecretId  *bool      `yaml:"bind_secret_id,omitempty"`
+	Period        string     `yaml:"period,omitempty"`
+	BoundCidrList stringList `yaml:"bound_cidr_list,omitempty"`
+	// Token parameters of the newer Vault versions
+	TokenPolicies        []string   `yaml:"token_policies,omitempty"`
+	TokenBoundCidrs      stringList `yaml:"token_bound_cidrs,omitempty"`
+	SecretIdBoundCidrs   stringList `yaml:"secret_id_bound_cidrs,omitempty"`
+	TokenNumUses         int        `yaml:"token_num_uses,omitempty"`
+	TokenType            string     `yaml:"token_type,omitempty"`
+	TokenExplicitMaxTtl  string     `yaml:"token_explicit_max_ttl,omitempty"`
+	TokenNoDefaultPolicy bool       `yaml:"token_no_default_policy,omitempty"`
+	LocalSecretIds       bool       `yaml:"local_secret_ids,omitempty"`
+	// Pinned RoleID that stays the same when the role is recreated
+	RoleId string `yaml:"role_id,omitempty"`
+	// How the 'issue-secret-id' command delivers new SecretIDs of the role
+	Deliver *secretIdDelivery `yaml:"deliver,omitempty"`
+	// What the issued SecretIDs of the role are expected to look like
+	SecretIdAudit *secretIdAudit `yaml:"secret_id_audit,omitempty"`
+}
+
+type secretIdAudit struct {
+	// Metadata keys every SecretID should carry
+	RequiredMetadata []string `yaml:"required_metadata,omitempty"`
+	// SecretIDs older than the age are flagged (ex: 720h)
+	MaxAge string `yaml:"max_age,omitempty"`
+	// Don't flag the SecretIDs that never expire
+	AllowNoTtl bool `yaml:"allow_no_ttl,omitempty"`
+	// Destroy the flagged SecretIDs during apply
+	Prune bool `yaml:"prune,omitempty"`
+}
+
+type secretIdDelivery struct {
+	// Metadata and CIDR restrictions of the SecretID
+	Metadata        map[string]string `yaml:"metadata,omitempty"`
+	CidrList        stringList        `yaml:"cidr_list,omitempty"`
+	TokenBoundCidrs stringList        `yaml:"token_bound_cidrs,omitempty"`
+	// Response wrapping TTL. Defaults to 5m
+	WrapTtl string `yaml:"wrap_ttl,omitempty"`
+	// stdout (default), file or kv
+	To     string `yaml:"to,omitempty"`
+	File   string `yaml:"file,omitempty"`
+	KvPath string `yaml:"kv_path,omitempty"`
+}
+
+// stringList is a YAML list that also accepts a comma separated string
+type stringList []string
+
+func (list *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	items := []string{}
+	if err := unmarshal(&items); err == nil {
+		*list = items
+		return nil
+	}
+	value := ""
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*list = splitList(value)
+	return nil
 }
 
 type fieldPair struct {
-	Key   string `yaml:"key"`
-	Value string `yaml:"value"`
+	Key string `yaml:"key"`
+	// Any YAML value: string, number, boolean, list or map
+	Value interface{} `yaml:"value"`
+	// Random value created once and never overwritten afterwards
+	Generate *generateSpec `yaml:"generate,omitempty"`
 }
 
 type genericSecret struct {
-	Path   string      `yaml:"path"`
-	Fields []fieldPair `yaml:"fields"`
+	// KV mount of the secret. Defaults to 'secret' unless the path is absolute
+	Mount    string      `yaml:"mount,omitempty"`
+	Path     string      `yaml:"path"`
+	Fields   []fieldPair `yaml:"fields"`
+	Metadata *kvMetadata `yaml:"metadata,omitempty"`
+	// File or folder to load the fields from. Every file in a folder becomes its own secret under the path
+	FromFile string `yaml:"from_file,omitempty"`
+	// dotenv, json, properties or yaml. Detected from the file extension by default
+	Format string `yaml:"format,omitempty"`
+	// replace (default), merge or create_only
+	Mode string `yaml:"mode,omitempty"`
 }
 
-type transitKey struct {
-	Type string `yaml:"type,omitempty"`
-	Name string `yaml:"name"`
-	// derived
-	// convergent_encryption
+// KV version 2 metadata of a secret
+type kvMetadata struct {
+	MaxVersions        int               `yaml:"max_versions,omitempty"`
+	CasRequired        bool              `yaml:"cas_required,omitempty"`
+	DeleteVersionAfter string            `yaml:"delete_version_after,omitempty"`
+	CustomMetadata     map[string]string `yaml:"custom_metadata,omitempty"`
 }
 
 type vaultConfig struct {
@@ -120,6 +223,82 @@ type vaultConfig struct {
 	AppRoles     []appRoleProperties `yaml:"approles,omitempty"`
 	Secrets      []genericSecret     `yaml:"secrets,omitempty"`
 	TransitKeys  []transitKey        `yaml:"transit_keys,omitempty"`
+	Tokens       *tokenAudit         `yaml:"tokens,omitempty"`
+	TokenRoles   *tokenRolesConfig   `yaml:"token_roles,omitempty"`
+	AuthRoles    []authRole          `yaml:"auth_roles,omitempty"`
+	Identity     *identityConfig     `yaml:"identity,omitempty"`
+}
+
+// identityConfig is managed only when the 'identity' section is present
+type identityConfig struct {
+	Entities []identityEntity `yaml:"entities,omitempty"`
+	Groups   []identityGroup  `yaml:"groups,omitempty"`
+	// What to do with the undeclared entities and groups: delete (default) or none
+	Prune string `yaml:"prune,omitempty"`
+}
+
+type identityEntity struct {
+	Name     string            `yaml:"name"`
+	Policies []string          `yaml:"policies,omitempty"`
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+	Disabled bool              `yaml:"disabled,omitempty"`
+	Aliases  []identityAlias   `yaml:"aliases,omitempty"`
+}
+
+// identityAlias binds an entity or an external group to a name on the auth backend mounted at the path
+type identityAlias struct {
+	Name  string `yaml:"name"`
+	Mount string `yaml:"mount"`
+}
+
+type identityGroup struct {
+	Name string `yaml:"name"`
+	// internal (default) or external
+	Type     string            `yaml:"type,omitempty"`
+	Policies []string          `yaml:"policies,omitempty"`
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+	// Members of the internal groups, referenced by name
+	MemberEntities []string `yaml:"member_entities,omitempty"`
+	MemberGroups   []string `yaml:"member_groups,omitempty"`
+	// Group of the external auth backend (ex: LDAP group) mapped to the external group
+	Alias *identityAlias `yaml:"alias,omitempty"`
+}
+
+// tokenRolesConfig is managed only when the 'token_roles' section is present. The section is either the list of
+// the roles or a map with the 'roles' and the 'prune' mode
+type tokenRolesConfig struct {
+	Roles []tokenRole `yaml:"roles,omitempty"`
+	// What to do with the undeclared token roles: delete (default) or none
+	Prune string `yaml:"prune,omitempty"`
+}
+
+func (config *tokenRolesConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	roles := []tokenRole{}
+	if err := unmarshal(&roles); err == nil {
+		config.Roles = roles
+		return nil
+	}
+	type plain tokenRolesConfig
+	return unmarshal((*plain)(config))
+}
+
+type tokenRole struct {
+	Name               string   `yaml:"name"`
+	AllowedPolicies    []string `yaml:"allowed_policies,omitempty"`
+	DisallowedPolicies []string `yaml:"disallowed_policies,omitempty"`
+	Orphan             bool     `yaml:"orphan,omitempty"`
+	Period             string   `yaml:"period,omitempty"`
+	// Defaults to true
+	Renewable      *bool      `yaml:"renewable,omitempty"`
+	ExplicitMaxTtl string     `yaml:"explicit_max_ttl,omitempty"`
+	PathSuffix     string     `yaml:"path_suffix,omitempty"`
+	BoundCidrs     stringList `yaml:"bound_cidrs,omitempty"`
+}
+
+// tokenAudit enables the audit of the issued tokens during apply
+type tokenAudit struct {
+	// Revoke the root tokens other than the one in use and the tokens with undeclared policies
+	RevokeUnexpectedTokens bool `yaml:"revoke_unexpected_tokens,omitempty"`
 }
 
 func InjestConfig(config *vaultConfig) error {
@@ -185,9 +364,40 @@ func (masterConfig *vaultConfig) mergeConfig(newConfig *vaultConfig) {
 	(*masterConfig).AppRoles = append(masterConfig.AppRoles, newConfig.AppRoles...)
 	(*masterConfig).Secrets = append(masterConfig.Secrets, newConfig.Secrets...)
 	(*masterConfig).TransitKeys = append(masterConfig.TransitKeys, newConfig.TransitKeys...)
+	(*masterConfig).AuthRoles = append(masterConfig.AuthRoles, newConfig.AuthRoles...)
+	if newConfig.Identity != nil {
+		if masterConfig.Identity == nil {
+			(*masterConfig).Identity = &identityConfig{}
+		}
+		(*masterConfig).Identity.Entities = append(masterConfig.Identity.Entities, newConfig.Identity.Entities...)
+		(*masterConfig).Identity.Groups = append(masterConfig.Identity.Groups, newConfig.Identity.Groups...)
+		if newConfig.Identity.Prune != "" {
+			(*masterConfig).Identity.Prune = newConfig.Identity.Prune
+		}
+	}
+	if newConfig.TokenRoles != nil {
+		if masterConfig.TokenRoles == nil {
+			(*masterConfig).TokenRoles = &tokenRolesConfig{}
+		}
+		(*masterConfig).TokenRoles.Roles = append(masterConfig.TokenRoles.Roles, newConfig.TokenRoles.Roles...)
+		if newConfig.TokenRoles.Prune != "" {
+			(*masterConfig).TokenRoles.Prune = newConfig.TokenRoles.Prune
+		}
+	}
+	if newConfig.Tokens != nil {
+		(*masterConfig).Tokens = newConfig.Tokens
+	}
 }
 
 func injestConfig(vault *vaultClient, conf *vaultConfig) error {
+	vault.summary = runSummary{}
+	defer vault.summary.report()
+
+	// ###   Validation
+	if validateMounts(conf) != nil {
+		return errors.New("Invalid mounts or roles")
+	}
+
 	// ###   Auth
 	if vault.UpdateAuthBackends(&conf.AuthBackends) != nil {
 		return errors.New("Failed to update Auth mounts")
@@ -218,23 +428,44 @@ func injestConfig(vault *vaultClient, conf *vaultConfig) error {
 	}
 
 	// ###   Users
-	if vault.CreateUserAccounts(conf.Users) != nil {
+	if vault.CreateUserAccounts(&conf.AuthBackends, conf.Users) != nil {
 		return errors.New("Failed to create User Accounts")
 	}
 
 	// ### AppRoles
-	if vault.UpdateAppRoles(&conf.AppRoles) != nil {
+	if vault.UpdateAppRoles(&conf.AuthBackends, &conf.AppRoles) != nil {
 		return errors.New("Failed to update Auth map")
 	}
 
+	// ### Auth Roles
+	if vault.UpdateAuthRoles(&conf.AuthBackends, &conf.AuthRoles) != nil {
+		return errors.New("Failed to update Auth Roles")
+	}
+
+	// ### Token Roles
+	if conf.TokenRoles != nil {
+		if vault.UpdateTokenRoles(conf.TokenRoles) != nil {
+			return errors.New("Failed to update Token Roles")
+		}
+	}
+
+	// ### Identity
+	if conf.Identity != nil {
+		if vault.UpdateIdentity(conf.Identity) != nil {
+			return errors.New("Failed to update Identity")
+		}
+	}
+
 	// ### Generic Secrets
-	if vault.UpdateGenericSecrets(&conf.Secrets) != nil {
+	if vault.UpdateGenericSecrets(&mountMap, &conf.Secrets) != nil {
 		return errors.New("Failed to update Generic Secrets")
 	}
 
-	// ### Transit Keys
-	if vault.UpdateTransitKeys(&conf.TransitKeys) != nil {
-		return errors.New("Failed to update Transit Keys")
+	// ### Tokens
+	if conf.Tokens != nil {
+		if vault.AuditTokens(&conf.Policies, conf.Tokens.RevokeUnexpectedTokens) != nil {
+			return errors.New("Failed to audit tokens")
+		}
 	}
 
 	return nil
@@ -279,53 +510,20 @@ func GetContentEvenIfFile(policy string) (string, error) {
 	return string(policyBody), nil
 }
 
-func (vault *vaultClient) ApplyMountConfig(mount mountInfo) error {
+func (vault *vaultClient) ApplyMountConfig(mount mountInfo, isNewMount bool) error {
 
 	log.Debug("Applying Mount configuration")
+	handler := getEngineHandler(mount.Type)
 	for _, cfg := range mount.Config {
-		path, ok := cfg["path"]
-		if !ok {
-			log.Error("Can't find 'path' property for config: " + mount.Path)
-			continue
-		}
-		config_path := filepath.Join(mount.Path, "config", path.(string))
-		log.Info("Configuring path: " + config_path)
-
-		data := make(map[string]interface{})
-
-		if ca_bundle_i, ok := cfg["ca_bundle"]; ok {
-			if ca_bundle_i == nil {
-				log.Error("Empty ca_bundle. Skipping ...")
-				continue
-			}
-			ca_bundle, success := ca_bundle_i.(map[string]string)
-			if !success {
-				ca_bundle_ii, success := ca_bundle_i.(map[interface{}]interface{})
-				if !success {
-					log.Error("Can't parse ca_bundle. Skipping ...")
-					continue
-				}
-				ca_bundle = getStringMapFromInterfaceMapInterface(ca_bundle_ii)
-			}
-			key, _ := GetContentEvenIfFile(ca_bundle["key"])
-			key = strings.TrimRight(key, "\n")
-			cert, _ := GetContentEvenIfFile(ca_bundle["cert"])
-			cert = strings.TrimRight(cert, "\n")
-			data["pem_bundle"] = cert + "\n" + key
-		} else if properties, ok := cfg["properties"]; ok {
-			for key, value := range properties.(map[string]string) {
-				data[key] = value
-			}
+		if err := handler.ApplyConfig(vault, &mount, cfg, isNewMount); err != nil {
+			log.Error(err)
+			return errors.New("Failed to configure mount " + mount.Path)
 		}
-
-		log.Debugf("Configuring mount with data: %#v", data)
-		_, err := vault.Client.Logical().Write(config_path, data)
-		if err != nil {
-			errStr := fmt.Sprintf("Failed to configure mount. %v", err)
-			log.Error(errStr)
-			return errors.New(errStr)
+	}
+	if reconciler, ok := handler.(mountReconciler); ok {
+		if err := reconciler.ReconcileMount(vault, &mount, isNewMount); err != nil {
+			return errors.New("Failed to configure mount " + mount.Path)
 		}
-		log.Debug("Wrote configuration to path %s: %#v", config_path, data)
 	}
 
 	return nil
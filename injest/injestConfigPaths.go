@@ -0,0 +1,241 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Write policies for configuration values that Vault doesn't return back (credentials, CA bundles, etc.)
+const (
+	// Write-only values are rewritten on every run
+	writePolicyAlways = "always_write"
+	// Write-only values are written when the config is created and never touched afterwards
+	writePolicyOnce = "write_once"
+)
+
+// writeOnceLedgerPath is the secret of the default KV mount that remembers the config paths written under
+// write_once. Vault can't tell if a write-only path was configured before, so the ledger is the only way to know.
+const writeOnceLedgerPath = "config2vault/write-once"
+
+func getWritePolicy(cfg map[string]interface{}, defaultPolicy string) string {
+	policy := getStringFromMap(&cfg, "write_policy", defaultPolicy)
+	switch policy {
+	case writePolicyAlways, writePolicyOnce:
+		return policy
+	}
+	log.Warningf("Unknown write_policy '%s'. Defaulting to '%s'", policy, defaultPolicy)
+	return defaultPolicy
+}
+
+// resolveProperties loads the content of the '@file' values. Lists and maps keep their YAML types and only their
+// string leaves are resolved.
+func resolveProperties(properties propertyBag) (map[string]interface{}, error) {
+	return resolvePropertiesWith(properties, GetContentEvenIfFile)
+}
+
+// resolveSecretProperties is resolveProperties for the credentials: the string leaves are loaded from '@file'
+// or from 'env:NAME' with resolveSecretValue
+func resolveSecretProperties(properties propertyBag) (map[string]interface{}, error) {
+	return resolvePropertiesWith(properties, resolveSecretValue)
+}
+
+// resolveSecretValue loads a credential from a file ('@path') or from an environment variable ('env:NAME')
+func resolveSecretValue(value string) (string, error) {
+	if strings.HasPrefix(value, "env:") {
+		name := strings.TrimPrefix(value, "env:")
+		resolved, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("Environment variable is not set: " + name)
+		}
+		return resolved, nil
+	}
+	if strings.HasPrefix(value, "@") {
+		content, err := GetContentEvenIfFile(value)
+		return strings.TrimRight(content, "\r\n"), err
+	}
+	return value, nil
+}
+
+func resolvePropertiesWith(properties propertyBag, resolve func(string) (string, error)) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(properties))
+	for key, value := range properties {
+		resolved, err := resolvePropertyValue(toJSONValue(value), resolve)
+		if err != nil {
+			log.Errorf("Failed to load property '%s'. %v", key, err)
+			return nil, err
+		}
+		data[key] = resolved
+	}
+	return data, nil
+}
+
+func resolvePropertyValue(value interface{}, resolve func(string) (string, error)) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return resolve(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved, err := resolvePropertyValue(item, resolve)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = resolved
+		}
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			resolved, err := resolvePropertyValue(item, resolve)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = resolved
+		}
+		return result, nil
+	}
+	return value, nil
+}
+
+// encodePropertyValue base64 encodes the string leaves of a value (ex: Consul policies)
+func encodePropertyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return base64.StdEncoding.EncodeToString([]byte(v))
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = encodePropertyValue(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = encodePropertyValue(item)
+		}
+		return result
+	}
+	return value
+}
+
+// reconcileConfigPath converges a single configuration endpoint. When the endpoint can be read back,
+// only the changed properties trigger a write. Otherwise the write policy decides.
+func (vault *vaultClient) reconcileConfigPath(kind string, configPath string, data map[string]interface{}, writePolicy string, isNew bool) error {
+	action := actionCreated
+	keys := []string{}
+
+	if !isNew {
+		current, err := vault.Client.Logical().Read(configPath)
+		switch {
+		case err != nil:
+			log.Debugf("Config path '%s' can't be read back. %v", configPath, err)
+			if writePolicy == writePolicyOnce {
+				written, err := vault.isWrittenOnce(configPath)
+				if err != nil {
+					return err
+				}
+				if written {
+					log.Infof("Keeping write-only config '%s' as is", configPath)
+					vault.summary.record(kind, configPath, actionSkipped)
+					return nil
+				}
+				// A config section added to an existing mount
+				break
+			}
+			action = actionUpdated
+		case current == nil || len(current.Data) == 0:
+			log.Infof("Config path '%s' is not configured yet", configPath)
+		default:
+			keys = diffProperties(data, current.Data, writePolicy == writePolicyOnce)
+			if len(keys) == 0 {
+				log.Infof("Config '%s' is up to date", configPath)
+				vault.summary.record(kind, configPath, actionUnchanged)
+				return nil
+			}
+			log.Warningf("Config '%s' differs in %v. Updating ...", configPath, keys)
+			action = actionUpdated
+		}
+	}
+
+	log.Debugf("Writing config to path '%s'", configPath)
+	if _, err := vault.Client.Logical().Write(configPath, data); err != nil {
+		errStr := fmt.Sprintf("Failed to write config to path '%s'. %v", configPath, err)
+		log.Error(errStr)
+		return errors.New(errStr)
+	}
+	vault.summary.record(kind, configPath, action, keys...)
+
+	if writePolicy == writePolicyOnce {
+		return vault.recordWrittenOnce(configPath)
+	}
+	return nil
+}
+
+// readWriteOnceLedger returns the KV mount and the content of the write-once ledger. The mount is nil when the
+// default KV mount doesn't exist.
+func (vault *vaultClient) readWriteOnceLedger() (*kvMount, map[string]interface{}, int, error) {
+	currentMounts, err := vault.ListMounts()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if _, ok := (*currentMounts)[defaultSecretsMount]; !ok {
+		return nil, nil, 0, nil
+	}
+	kv := newKvMount(nil, currentMounts, defaultSecretsMount)
+	ledger, version, err := vault.ReadSecret(kv, writeOnceLedgerPath)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if ledger == nil {
+		ledger = map[string]interface{}{}
+	}
+	return kv, ledger, version, nil
+}
+
+// isWrittenOnce tells if the write-only config path was written before. Without the ledger the path is
+// considered written, so a rotated credential is never overwritten.
+func (vault *vaultClient) isWrittenOnce(configPath string) (bool, error) {
+	kv, ledger, _, err := vault.readWriteOnceLedger()
+	if err != nil {
+		return false, err
+	}
+	if kv == nil {
+		log.Warningf("Can't track write-only config '%s' without the '%s' mount", configPath, defaultSecretsMount)
+		return true, nil
+	}
+	_, ok := ledger[configPath]
+	return ok, nil
+}
+
+func (vault *vaultClient) recordWrittenOnce(configPath string) error {
+	kv, ledger, version, err := vault.readWriteOnceLedger()
+	if err != nil || kv == nil {
+		return err
+	}
+	if _, ok := ledger[configPath]; ok {
+		return nil
+	}
+	ledger[configPath] = time.Now().UTC().Format(time.RFC3339)
+	return vault.writeSecret(kv, writeOnceLedgerPath, ledger, version)
+}
@@ -0,0 +1,310 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+)
+
+// databaseEngine manages the connections of the unified database engine. Its roles and static roles are declared
+// in the 'roles' section with 'db_name' referencing the connection.
+type databaseEngine struct {
+	baseEngine
+}
+
+type databaseConnection struct {
+	Name       string `yaml:"name"`
+	PluginName string `yaml:"plugin_name"`
+	// The connection_url, username and password can be loaded from '@file' or from 'env:NAME'
+	ConnectionUrl string     `yaml:"connection_url,omitempty"`
+	Username      string     `yaml:"username,omitempty"`
+	Password      string     `yaml:"password,omitempty"`
+	AllowedRoles  stringList `yaml:"allowed_roles,omitempty"`
+	// Vault checks the connection before saving it. Defaults to true
+	VerifyConnection *bool `yaml:"verify_connection,omitempty"`
+	// Rotate the root password once the connection is created, so only Vault knows it
+	RotateRoot bool `yaml:"rotate_root,omitempty"`
+	// always_write or write_once. Decides when the password is written. Defaults to write_once with rotate_root
+	WritePolicy string `yaml:"write_policy,omitempty"`
+	// Plugin specific properties (ex: max_open_connections)
+	Properties propertyBag `yaml:"properties,omitempty"`
+}
+
+// connections returns the 'connections' section of the mount
+func (engine *databaseEngine) connections(mount *mountInfo) ([]databaseConnection, error) {
+	connections := []databaseConnection{}
+	err := decodeMountSection(mount, "connections", &connections)
+	return connections, err
+}
+
+func (engine *databaseEngine) ValidateMount(mount *mountInfo) error {
+	if err := engine.baseEngine.ValidateMount(mount); err != nil {
+		return err
+	}
+
+	connections, err := engine.connections(mount)
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, connection := range connections {
+		switch {
+		case connection.Name == "":
+			log.Errorf("Database connection of the mount '%s' has no name", mount.Path)
+			return errors.New("Database connection without name on " + mount.Path)
+		case connection.PluginName == "":
+			log.Errorf("Database connection '%s' of the mount '%s' has no 'plugin_name'", connection.Name, mount.Path)
+			return errors.New("Database connection without plugin " + connection.Name)
+		case names[connection.Name]:
+			log.Errorf("Database connection '%s' is declared twice on the mount '%s'", connection.Name, mount.Path)
+			return errors.New("Duplicate database connection " + connection.Name)
+		}
+		switch connection.WritePolicy {
+		case "", writePolicyAlways, writePolicyOnce:
+		default:
+			log.Errorf("Unknown write_policy '%s' of the database connection '%s'", connection.WritePolicy, connection.Name)
+			return errors.New("Unknown write policy " + connection.WritePolicy)
+		}
+		names[connection.Name] = true
+	}
+	return nil
+}
+
+// EncodeRole checks the connection of the role. Vault keeps the statements as lists, so a single statement
+// block is sent as a list too and the roles can be compared.
+func (engine *databaseEngine) EncodeRole(mount *mountInfo, collection *roleCollection, properties propertyBag) (map[string]interface{}, error) {
+	data, err := engine.baseEngine.EncodeRole(mount, collection, properties)
+	if err != nil {
+		return nil, err
+	}
+
+	dbName := getStringFromMap(&data, "db_name", "")
+	if dbName == "" {
+		return nil, errors.New("Missing 'db_name' of the database role")
+	}
+	connections, err := engine.connections(mount)
+	if err != nil {
+		return nil, err
+	}
+	if len(connections) > 0 {
+		declared := false
+		for _, connection := range connections {
+			declared = declared || connection.Name == dbName
+		}
+		if !declared {
+			log.Errorf("Database connection '%s' is not declared on the mount '%s'", dbName, mount.Path)
+			return nil, errors.New("Unknown database connection " + dbName)
+		}
+	}
+
+	for key, value := range data {
+		if statements, ok := value.(string); ok && strings.HasSuffix(key, "_statements") {
+			data[key] = []interface{}{statements}
+		}
+	}
+	return data, nil
+}
+
+// ReconcileMount converges the declared connections of the mount and removes the undeclared ones unless
+// 'prune: none'. The mounts without the 'connections' section are left alone.
+func (engine *databaseEngine) ReconcileMount(vault *vaultClient, mount *mountInfo, isNewMount bool) error {
+	connections, err := engine.connections(mount)
+	if err != nil {
+		return err
+	}
+
+	configPath := path.Join(mount.Path, "config")
+	currentConnections := map[string]bool{}
+	if !isNewMount {
+		result, err := vault.Client.Logical().List(configPath)
+		if err != nil {
+			log.Errorf("Failed to list database connections of '%s'. %v", mount.Path, err)
+			return err
+		}
+		if result != nil {
+			for _, name := range getStringArrayFromMap(&result.Data, "keys", []string{}) {
+				currentConnections[name] = true
+			}
+		}
+	}
+
+	// Without the 'connections' section the connections are managed outside of the rules
+	if len(connections) == 0 {
+		names := make([]string, 0, len(currentConnections))
+		for name := range currentConnections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			vault.summary.record("database connection", path.Join(configPath, name), actionSkipped)
+		}
+		return nil
+	}
+
+	for _, connection := range connections {
+		if err := vault.reconcileDatabaseConnection(mount, &connection); err != nil {
+			return err
+		}
+		delete(currentConnections, connection.Name)
+	}
+
+	// Runaway connections
+	runaway := make([]string, 0, len(currentConnections))
+	for name := range currentConnections {
+		runaway = append(runaway, name)
+	}
+	sort.Strings(runaway)
+	for _, name := range runaway {
+		connectionPath := path.Join(configPath, name)
+		if mount.Prune == authPruneNone {
+			log.Infof("Keeping undeclared database connection: %s", connectionPath)
+			vault.summary.record("database connection", connectionPath, actionSkipped)
+			continue
+		}
+		log.Warningf("Found runaway database connection: %s. Removing ...", connectionPath)
+		if _, err := vault.Client.Logical().Delete(connectionPath); err != nil {
+			log.Errorf("Failed to delete database connection '%s'. %v", connectionPath, err)
+			return errors.New("Failed to delete database connection " + connectionPath)
+		}
+		vault.summary.record("database connection", connectionPath, actionDeleted)
+	}
+
+	return nil
+}
+
+func (vault *vaultClient) reconcileDatabaseConnection(mount *mountInfo, connection *databaseConnection) error {
+	connectionPath := path.Join(mount.Path, "config", connection.Name)
+	data, err := connection.toData()
+	if err != nil {
+		return errors.New("Failed to load database connection " + connectionPath)
+	}
+
+	writePolicy := connection.WritePolicy
+	if writePolicy == "" {
+		writePolicy = writePolicyAlways
+		if connection.RotateRoot {
+			// The rotated root password is known only to Vault, the declared one is the initial password
+			writePolicy = writePolicyOnce
+		}
+	}
+
+	current, err := vault.Client.Logical().Read(connectionPath)
+	if err != nil {
+		log.Errorf("Failed to read database connection '%s'. %v", connectionPath, err)
+		return err
+	}
+
+	if current == nil {
+		if _, err := vault.Client.Logical().Write(connectionPath, data); err != nil {
+			log.Errorf("Failed to create database connection '%s'. %v", connectionPath, err)
+			return errors.New("Failed to create database connection " + connectionPath)
+		}
+		vault.summary.record("database connection", connectionPath, actionCreated)
+
+		if connection.RotateRoot {
+			rotatePath := path.Join(mount.Path, "rotate-root", connection.Name)
+			log.Infof("Rotating root credentials of the database connection '%s'", connectionPath)
+			if _, err := vault.Client.Logical().Write(rotatePath, map[string]interface{}{}); err != nil {
+				log.Errorf("Failed to rotate root credentials of '%s'. %v", connectionPath, err)
+				return errors.New("Failed to rotate root credentials of " + connectionPath)
+			}
+			vault.summary.record("database connection", rotatePath, actionUpdated, "root_credentials")
+		}
+		return nil
+	}
+
+	// Vault returns the plugin properties in 'connection_details' and never returns the password
+	currentData := map[string]interface{}{}
+	for key, value := range current.Data {
+		currentData[key] = value
+	}
+	details := getStringMapInterfaceFromMap(&current.Data, "connection_details", &map[string]interface{}{})
+	for key, value := range *details {
+		currentData[key] = value
+	}
+	desiredData := map[string]interface{}{}
+	for key, value := range data {
+		if key != "password" && key != "verify_connection" {
+			desiredData[key] = value
+		}
+	}
+
+	changed := diffProperties(desiredData, currentData, true)
+	if _, ok := data["password"]; ok {
+		if writePolicy == writePolicyAlways {
+			changed = append(changed, "password")
+		} else {
+			// Vault keeps the current password when it is not part of the update
+			delete(data, "password")
+		}
+	}
+	if len(changed) == 0 {
+		log.Debugf("Database connection '%s' is identical. Skipping ...", connectionPath)
+		vault.summary.record("database connection", connectionPath, actionUnchanged)
+		return nil
+	}
+
+	log.Warningf("Database connection '%s' is NOT identical in %v. Updating ...", connectionPath, changed)
+	if _, err := vault.Client.Logical().Write(connectionPath, data); err != nil {
+		log.Errorf("Failed to update database connection '%s'. %v", connectionPath, err)
+		return errors.New("Failed to update database connection " + connectionPath)
+	}
+	vault.summary.record("database connection", connectionPath, actionUpdated, changed...)
+	return nil
+}
+
+// toData returns the properties of the connection as they are written to Vault
+func (connection *databaseConnection) toData() (map[string]interface{}, error) {
+	data, err := resolveProperties(connection.Properties)
+	if err != nil {
+		return nil, err
+	}
+
+	verifyConnection := true
+	if connection.VerifyConnection != nil {
+		verifyConnection = *connection.VerifyConnection
+	}
+	allowedRoles := []string(connection.AllowedRoles)
+	if allowedRoles == nil {
+		allowedRoles = []string{}
+	}
+	data["plugin_name"] = connection.PluginName
+	data["allowed_roles"] = allowedRoles
+	data["verify_connection"] = verifyConnection
+
+	secrets := map[string]string{
+		"connection_url": connection.ConnectionUrl,
+		"username":       connection.Username,
+		"password":       connection.Password,
+	}
+	for key, value := range secrets {
+		if value == "" {
+			continue
+		}
+		resolved, err := resolveSecretValue(value)
+		if err != nil {
+			log.Errorf("Failed to load '%s' of the database connection '%s'. %v", key, connection.Name, err)
+			return nil, err
+		}
+		data[key] = resolved
+	}
+	return data, nil
+}
@@ -0,0 +1,351 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EngineHandler implements the behaviour that is specific to a secret engine type. The handlers are registered
+// per mount type in engineHandlers, the types without a handler get the defaultEngine.
+type EngineHandler interface {
+	// ValidateMount checks the declared mount before it is mounted or reconfigured
+	ValidateMount(mount *mountInfo) error
+	// ApplyConfig converges a single 'config' section of the mount
+	ApplyConfig(vault *vaultClient, mount *mountInfo, cfg map[string]interface{}, isNewMount bool) error
+	// RoleCollections lists the sub-paths of the mount that hold roles. The first one is the default.
+	RoleCollections() []roleCollection
+	// EncodeRole converts the declared role properties to the data Vault expects
+	EncodeRole(mount *mountInfo, collection *roleCollection, properties propertyBag) (map[string]interface{}, error)
+	ListRoles(vault *vaultClient, collectionPath string) ([]string, error)
+	// ReadRole returns the properties of the role or nil if it doesn't exist
+	ReadRole(vault *vaultClient, rolePath string) (propertyBag, error)
+	WriteRole(vault *vaultClient, rolePath string, data map[string]interface{}) error
+	DeleteRole(vault *vaultClient, rolePath string) error
+	// DescribeDrift returns the sorted list of the declared properties that differ in the current role
+	DescribeDrift(desired map[string]interface{}, current propertyBag) []string
+}
+
+// mountReconciler is implemented by the handlers that manage more than the 'config' sections of the mount
+// (ex: the database connections)
+type mountReconciler interface {
+	ReconcileMount(vault *vaultClient, mount *mountInfo, isNewMount bool) error
+}
+
+// configBinder is implemented by the handlers that accept declarations from the top level sections of the rules
+// (ex: 'transit_keys'). BindConfig moves them to the sections of their mounts before the mounts are validated.
+type configBinder interface {
+	BindConfig(conf *vaultConfig) error
+}
+
+// roleCollection is a sub-path of a secret engine that holds its roles
+type roleCollection struct {
+	Path string
+	// The runaway roles of the collection are found with LIST and removed. Off for the collections that hold
+	// state Vault can't recreate (TOTP seeds, rotated passwords of the static roles)
+	List bool
+}
+
+var engineHandlers = map[string]EngineHandler{
+	"aws":        &baseEngine{collections: []roleCollection{{Path: "roles", List: true}}},
+	"azure":      &baseEngine{collections: []roleCollection{{Path: "roles", List: true}}},
+	"consul":     &baseEngine{collections: []roleCollection{{Path: "roles", List: true}}},
+	"database":   &databaseEngine{baseEngine{collections: []roleCollection{{Path: "roles", List: true}, {Path: "static-roles", List: false}}, sections: []string{"connections"}}},
+	"gcp":        &baseEngine{collections: []roleCollection{{Path: "roleset", List: true}, {Path: "static-account", List: false}}},
+	"generic":    &kvEngine{},
+	"kubernetes": &baseEngine{collections: []roleCollection{{Path: "roles", List: true}}},
+	"kv":         &kvEngine{},
+	"ldap":       &baseEngine{collections: []roleCollection{{Path: "role", List: true}, {Path: "static-role", List: false}}},
+	"mysql":      &baseEngine{collections: []roleCollection{{Path: "roles", List: true}}},
+	"nomad":      &baseEngine{collections: []roleCollection{{Path: "role", List: true}}},
+	"pki":        &pkiEngine{baseEngine{collections: []roleCollection{{Path: "roles", List: true}}}},
+	"postgresql": &baseEngine{collections: []roleCollection{{Path: "roles", List: true}}},
+	"rabbitmq":   &baseEngine{collections: []roleCollection{{Path: "roles", List: true}}},
+	"ssh":        &baseEngine{collections: []roleCollection{{Path: "roles", List: true}, {Path: "keys", List: false}}},
+	"terraform":  &baseEngine{collections: []roleCollection{{Path: "role", List: true}}},
+	"totp":       &baseEngine{collections: []roleCollection{{Path: "keys", List: false}}},
+	"transit":    &transitEngine{baseEngine{sections: []string{"keys", "transit_keys"}}},
+}
+
+var defaultEngine EngineHandler = &baseEngine{}
+
+func getEngineHandler(mountType string) EngineHandler {
+	if handler, ok := engineHandlers[mountType]; ok {
+		return handler
+	}
+	return defaultEngine
+}
+
+// validateMounts binds the top level declarations to their mounts, then checks the declared mounts and the
+// collections of their roles before anything is changed in Vault
+func validateMounts(conf *vaultConfig) error {
+	mountTypes := make([]string, 0, len(engineHandlers))
+	for mountType := range engineHandlers {
+		mountTypes = append(mountTypes, mountType)
+	}
+	sort.Strings(mountTypes)
+	for _, mountType := range mountTypes {
+		if binder, ok := engineHandlers[mountType].(configBinder); ok {
+			if err := binder.BindConfig(conf); err != nil {
+				return err
+			}
+		}
+	}
+
+	mountMap := map[string]mountInfo{}
+	for _, mount := range conf.Mounts {
+		if mount.Path == "" {
+			mount.Path = mount.Type
+		}
+		mount.Path = strings.Trim(mount.Path, "/")
+		if err := getEngineHandler(mount.Type).ValidateMount(&mount); err != nil {
+			return err
+		}
+		mountMap[mount.Path] = mount
+	}
+
+	for _, role := range conf.Roles {
+		mountPath := strings.Trim(role.Path, "/")
+		mount, ok := mountMap[mountPath]
+		if !ok {
+			log.Errorf("Mount '%s' of the role '%s' is not declared in 'mounts'", mountPath, role.Name)
+			return errors.New("Role mount is not declared: " + mountPath)
+		}
+		if _, ok := findRoleCollection(getEngineHandler(mount.Type), role.Collection); !ok {
+			log.Errorf("Mount '%s' of type '%s' doesn't support '%s' roles", mountPath, mount.Type, role.Collection)
+			return errors.New("Unsupported roles on mount " + mountPath)
+		}
+	}
+	return nil
+}
+
+// decodeMountSection decodes the engine specific section of the mount into out. out is left alone when the mount
+// doesn't declare the section.
+func decodeMountSection(mount *mountInfo, name string, out interface{}) error {
+	value, ok := mount.Sections[name]
+	if !ok || value == nil {
+		return nil
+	}
+
+	// The section is either parsed from the rules or set by the code, so it is converted through YAML
+	data, err := yaml.Marshal(value)
+	if err == nil {
+		err = yaml.Unmarshal(data, out)
+	}
+	if err != nil {
+		log.Errorf("Invalid '%s' section of the mount '%s'. %v", name, mount.Path, err)
+		return errors.New("Invalid mount section " + name)
+	}
+	return nil
+}
+
+// findRoleCollection returns the role collection of the handler. An empty name selects the default collection.
+func findRoleCollection(handler EngineHandler, name string) (*roleCollection, bool) {
+	collections := handler.RoleCollections()
+	if len(collections) == 0 {
+		return nil, false
+	}
+	if name == "" {
+		return &collections[0], true
+	}
+	name = strings.Trim(name, "/")
+	for i := range collections {
+		if collections[i].Path == name {
+			return &collections[i], true
+		}
+	}
+	return nil, false
+}
+
+// listableRoleCollections returns the role collections of the mount whose runaway roles are removed
+func listableRoleCollections(mount mountInfo) []string {
+	paths := []string{}
+	if mount.Prune == authPruneNone {
+		return paths
+	}
+	for _, collection := range getEngineHandler(mount.Type).RoleCollections() {
+		if collection.List {
+			paths = append(paths, path.Join(mount.Path, collection.Path))
+		}
+	}
+	return paths
+}
+
+// baseEngine is the behaviour shared by the engines: 'config/<path>' sections and roles stored as plain
+// properties under the role collections
+type baseEngine struct {
+	collections []roleCollection
+	// The engine specific sections the mount accepts (ex: 'connections')
+	sections []string
+}
+
+// ValidateMount checks the prune mode of the runaway roles (delete by default, or none) and rejects the
+// sections of the mount that the engine doesn't know
+func (engine *baseEngine) ValidateMount(mount *mountInfo) error {
+	switch mount.Prune {
+	case "", authPruneDelete, authPruneNone:
+	default:
+		log.Errorf("Unknown prune mode '%s' of the mount '%s'", mount.Prune, mount.Path)
+		return errors.New("Unknown prune mode " + mount.Prune)
+	}
+	return validateMountSections(mount, engine.sections)
+}
+
+// validateMountSections rejects the keys of the mount that are neither common mount options nor accepted
+// sections of its engine, so a misspelled key isn't silently ignored
+func validateMountSections(mount *mountInfo, accepted []string) error {
+	unknown := []string{}
+	for name := range mount.Sections {
+		known := false
+		for _, section := range accepted {
+			known = known || section == name
+		}
+		if !known {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	log.Errorf("Unknown keys %v of the mount '%s' of type '%s'", unknown, mount.Path, mount.Type)
+	return errors.New("Unknown mount keys " + strings.Join(unknown, ", "))
+}
+
+func (engine *baseEngine) ApplyConfig(vault *vaultClient, mount *mountInfo, cfg map[string]interface{}, isNewMount bool) error {
+	configPath, ok := cfg["path"]
+	if !ok {
+		log.Error("Can't find 'path' property for config: " + mount.Path)
+		return nil
+	}
+	fullPath := path.Join(mount.Path, "config", fmt.Sprintf("%v", configPath))
+	log.Info("Configuring path: " + fullPath)
+
+	data := make(map[string]interface{})
+	if properties_i, ok := cfg["properties"]; ok {
+		properties, success := getPropertyBag(properties_i)
+		if !success {
+			log.Errorf("Can't parse properties for config: %s. Skipping ...", fullPath)
+			return nil
+		}
+		resolved, err := resolveProperties(properties)
+		if err != nil {
+			return err
+		}
+		data = resolved
+	}
+
+	log.Debugf("Configuring mount with data: %#v", data)
+	return vault.reconcileConfigPath("mount config", fullPath, data, getWritePolicy(cfg, writePolicyAlways), isNewMount)
+}
+
+func (engine *baseEngine) RoleCollections() []roleCollection {
+	return engine.collections
+}
+
+// EncodeRole loads the '@file' values. 'policy_base64_encode' encodes all the string values of the role.
+func (engine *baseEngine) EncodeRole(mount *mountInfo, collection *roleCollection, properties propertyBag) (map[string]interface{}, error) {
+	data, err := resolveProperties(properties)
+	if err != nil {
+		return nil, err
+	}
+	if mount.PolicyBase64Encode {
+		for propertyName, value := range data {
+			data[propertyName] = encodePropertyValue(value)
+		}
+	}
+	return data, nil
+}
+
+func (engine *baseEngine) ListRoles(vault *vaultClient, collectionPath string) ([]string, error) {
+	roles := []string{}
+	log.Debug("Dumping roles at path " + collectionPath)
+	secret, err := vault.Client.Logical().List(collectionPath)
+	if err != nil {
+		// Note: Some secret backends do not implement this functionality
+		log.Info("Can't get list of roles at path: " + collectionPath)
+		return roles, errors.New("Didn't get list of roles")
+	}
+	if secret == nil {
+		return roles, nil
+	}
+	return getStringArrayFromMap(&secret.Data, "keys", roles), nil
+}
+
+func (engine *baseEngine) ReadRole(vault *vaultClient, rolePath string) (propertyBag, error) {
+	log.Debugf("Reading role from path: %s", rolePath)
+	role, err := vault.Client.Logical().Read(rolePath)
+	if err != nil {
+		log.Error("Failed to read role: " + rolePath)
+		return nil, err
+	}
+	log.Debugf("Role content: %#v", role)
+	if role == nil {
+		return nil, nil
+	}
+	if role.Data == nil {
+		return propertyBag{}, nil
+	}
+	return propertyBag(role.Data), nil
+}
+
+func (engine *baseEngine) WriteRole(vault *vaultClient, rolePath string, data map[string]interface{}) error {
+	log.Debugf("Applying to role path '%s' role policy: %#v", rolePath, data)
+	secret, err := vault.Client.Logical().Write(rolePath, data)
+	if err != nil {
+		log.Error(err)
+		return errors.New("Failed to apply role policy to role path: " + rolePath)
+	}
+	if secret != nil {
+		log.Debugf("Received secret: %#v", *secret)
+	}
+	return nil
+}
+
+func (engine *baseEngine) DeleteRole(vault *vaultClient, rolePath string) error {
+	if _, err := vault.Client.Logical().Delete(rolePath); err != nil {
+		log.Error("Failed to delete role " + rolePath)
+		return errors.New("Failed to delete role " + rolePath)
+	}
+	return nil
+}
+
+// DescribeDrift compares only the declared properties, the defaults Vault fills in are ignored
+func (engine *baseEngine) DescribeDrift(desired map[string]interface{}, current propertyBag) []string {
+	return diffProperties(desired, current, false)
+}
+
+// kvEngine holds the generic secrets. It has no roles and its runaway secrets are pruned according to 'prune'.
+type kvEngine struct {
+	baseEngine
+}
+
+func (engine *kvEngine) ValidateMount(mount *mountInfo) error {
+	switch mount.Prune {
+	case "", kvPruneDelete, kvPruneDestroy, kvPruneNone:
+		return validateMountSections(mount, nil)
+	}
+	log.Errorf("Unknown prune mode '%s' of the mount '%s'", mount.Prune, mount.Path)
+	return errors.New("Unknown prune mode " + mount.Prune)
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	generatePassword = "password"
+	generateHex      = "hex"
+	generateBase64   = "base64"
+	generateRsa      = "rsa"
+)
+
+var generateCharsets = map[string]string{
+	"alnum":   "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789",
+	"alpha":   "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+	"numeric": "0123456789",
+	"hex":     "0123456789abcdef",
+	"ascii":   "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789!#$%&()*+,-./:;<=>?@[]^_{|}~",
+}
+
+// generateSpec describes a random value that is created once and never overwritten afterwards
+type generateSpec struct {
+	// password (default), hex, base64 or rsa
+	Type string `yaml:"type,omitempty"`
+	// Length of the password
+	Length int `yaml:"length,omitempty"`
+	// Charset of the password: alnum (default), alpha, numeric, hex or ascii
+	Charset string `yaml:"charset,omitempty"`
+	// Number of random bytes for the hex and base64 values
+	Bytes int `yaml:"bytes,omitempty"`
+	// Size of the RSA key
+	Bits int `yaml:"bits,omitempty"`
+}
+
+func (spec *generateSpec) generate() (string, error) {
+	switch spec.Type {
+	case "", generatePassword:
+		length := spec.Length
+		if length <= 0 {
+			length = 32
+		}
+		charsetName := spec.Charset
+		if charsetName == "" {
+			charsetName = "alnum"
+		}
+		charset, ok := generateCharsets[charsetName]
+		if !ok {
+			log.Errorf("Unknown charset '%s'", charsetName)
+			return "", errors.New("Unknown charset " + charsetName)
+		}
+		return randomString(length, charset)
+	case generateHex, generateBase64:
+		size := spec.Bytes
+		if size <= 0 {
+			size = 32
+		}
+		buf := make([]byte, size)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		if spec.Type == generateHex {
+			return hex.EncodeToString(buf), nil
+		}
+		return base64.StdEncoding.EncodeToString(buf), nil
+	case generateRsa:
+		bits := spec.Bits
+		if bits <= 0 {
+			bits = 2048
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return "", err
+		}
+		block := pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}
+		return string(pem.EncodeToMemory(&block)), nil
+	}
+
+	log.Errorf("Unknown type '%s' of the generated value", spec.Type)
+	return "", errors.New("Unknown type of the generated value " + spec.Type)
+}
+
+func randomString(length int, charset string) (string, error) {
+	result := make([]byte, length)
+	max := big.NewInt(int64(len(charset)))
+	for i := range result {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		result[i] = charset[n.Int64()]
+	}
+	return string(result), nil
+}
+
+// UnmarshalYAML accepts either a plain password or a 'generate' section in place of the password
+func (user *userAccount) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainUserAccount userAccount
+
+	raw := map[string]interface{}{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	password, ok := raw["password"].(map[interface{}]interface{})
+	if !ok {
+		return unmarshal((*plainUserAccount)(user))
+	}
+
+	delete(raw, "password")
+	if err := remarshal(raw, (*plainUserAccount)(user)); err != nil {
+		return err
+	}
+	passwordSpec := struct {
+		Generate *generateSpec `yaml:"generate"`
+	}{}
+	if err := remarshal(password, &passwordSpec); err != nil {
+		return err
+	}
+	if passwordSpec.Generate == nil {
+		return errors.New("Password of the user '" + user.Name + "' should be a string or a 'generate' section")
+	}
+	user.GeneratePassword = passwordSpec.Generate
+
+	return nil
+}
+
+func remarshal(in interface{}, out interface{}) error {
+	content, err := yaml.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(content, out)
+}
@@ -18,64 +18,468 @@ package injest
 
 import (
 	"config2vault/log"
+	"errors"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
-func (vault *vaultClient) UpdateGenericSecrets(secrets *[]genericSecret) error {
+const (
+	defaultSecretsMount = "secret"
+
+	// Soft-delete the latest version of a KV v2 secret (regular delete for KV v1)
+	kvPruneDelete = "delete"
+	// Remove all the versions and the metadata of a KV v2 secret
+	kvPruneDestroy = "destroy"
+	// Only warn about the secrets that are not in the rules
+	kvPruneNone = "none"
+
+	// The secret holds exactly the declared fields
+	secretModeReplace = "replace"
+	// Only the declared fields are managed. The rest of the fields are left alone.
+	secretModeMerge = "merge"
+	// The secret is seeded once and never overwritten
+	secretModeCreateOnly = "create_only"
+)
+
+// kvMount describes a KV secrets engine and knows where the data lives for each version of the engine
+type kvMount struct {
+	Path    string
+	Version int
+	Prune   string
+}
+
+func (kv *kvMount) dataPath(secretPath string) string {
+	if kv.Version == 2 {
+		return filepath.Join(kv.Path, "data", secretPath)
+	}
+	return filepath.Join(kv.Path, secretPath)
+}
+
+func (kv *kvMount) metadataPath(secretPath string) string {
+	return filepath.Join(kv.Path, "metadata", secretPath)
+}
+
+func (kv *kvMount) listPath(secretPath string) string {
+	if kv.Version == 2 {
+		return filepath.Join(kv.Path, "metadata", secretPath) + "/"
+	}
+	return filepath.Join(kv.Path, secretPath) + "/"
+}
+
+func (vault *vaultClient) UpdateGenericSecrets(mounts *map[string]mountInfo, secrets *[]genericSecret) error {
 	log.Debug("Updating secrets")
-	currentSecrets, err := vault.ListSecrets()
+	currentMounts, err := vault.ListMounts()
+	if err != nil {
+		return err
+	}
+
+	expandedSecrets, err := expandSecretFiles(*secrets)
 	if err != nil {
 		return err
 	}
 
-	if len(*secrets) == 0 {
+	// Only the mounts with managed secrets are pruned. The default mount is always managed.
+	managedSecrets := map[string][]genericSecret{}
+	if _, ok := (*currentMounts)[defaultSecretsMount]; ok {
+		managedSecrets[defaultSecretsMount] = []genericSecret{}
+	}
+	for _, entry := range expandedSecrets {
+		switch entry.Mode {
+		case "", secretModeReplace, secretModeMerge, secretModeCreateOnly:
+		default:
+			log.Errorf("Unknown mode '%s' of the secret '%s'", entry.Mode, entry.Path)
+			return errors.New("Unknown secret mode " + entry.Mode)
+		}
+		mountPath, secretPath, err := resolveSecretMount(&entry, currentMounts)
+		if err != nil {
+			return err
+		}
+		entry.Mount = mountPath
+		entry.Path = secretPath
+		managedSecrets[mountPath] = append(managedSecrets[mountPath], entry)
+	}
+
+	if len(expandedSecrets) == 0 {
 		log.Info("No Secets to injest")
-	} else {
-		for _, entry := range *secrets {
-			// Try to remove key path if present
-			entry.Path = filepath.Join("secret", entry.Path)
-			delete(*currentSecrets, entry.Path)
-			err := vault.SetSecret(&entry)
+	}
+
+	mountPaths := make([]string, 0, len(managedSecrets))
+	for mountPath := range managedSecrets {
+		mountPaths = append(mountPaths, mountPath)
+	}
+	sort.Strings(mountPaths)
+
+	for _, mountPath := range mountPaths {
+		kv := newKvMount(mounts, currentMounts, mountPath)
+		if err := vault.updateMountSecrets(kv, managedSecrets[mountPath]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (vault *vaultClient) updateMountSecrets(kv *kvMount, secrets []genericSecret) error {
+	currentSecrets, err := vault.listKvSecrets(kv)
+	if err != nil {
+		return err
+	}
+
+	if kv.Path == defaultSecretsMount {
+		// Managed by the config sections with write_once
+		delete(*currentSecrets, writeOnceLedgerPath)
+	}
+
+	for _, entry := range secrets {
+		// Try to remove key path if present
+		delete(*currentSecrets, entry.Path)
+		err := vault.SetSecret(kv, &entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	for path, _ := range *currentSecrets {
+		// KV version 2 lists the soft-deleted secrets too. They were pruned by a previous run.
+		if kv.Version == 2 && kv.Prune == kvPruneDelete {
+			deleted, err := vault.isSecretDeleted(kv, path)
 			if err != nil {
 				return err
 			}
+			if deleted {
+				vault.summary.record("secret", filepath.Join(kv.Path, path), actionUnchanged)
+				continue
+			}
+		}
+		log.Warning("Leftover secret: " + filepath.Join(kv.Path, path))
+		if kv.Prune == kvPruneNone {
+			vault.summary.record("secret", filepath.Join(kv.Path, path), actionSkipped)
+			continue
 		}
+		vault.DeleteSecret(kv, path)
 	}
 
-	for path, _ := range *currentSecrets {
-		log.Warning("Leftover secret: " + path)
-		vault.DeleteSecret(path)
+	return nil
+}
+
+// resolveSecretMount splits the secret path into the KV mount and the path inside the mount.
+// The mount is either declared explicitly, is a prefix of an absolute path or defaults to 'secret'.
+func resolveSecretMount(secret *genericSecret, currentMounts *map[string]mountInfo) (string, string, error) {
+	mountPath := strings.Trim(secret.Mount, "/")
+	secretPath := strings.Trim(secret.Path, "/")
+
+	if mountPath == "" && strings.HasPrefix(secret.Path, "/") {
+		// Longest matching mount wins
+		for path := range *currentMounts {
+			if strings.HasPrefix(secretPath, path+"/") && len(path) > len(mountPath) {
+				mountPath = path
+			}
+		}
+		if mountPath == "" {
+			log.Errorf("Can't find a mount for the secret '%s'", secret.Path)
+			return "", "", errors.New("Can't find a mount for the secret " + secret.Path)
+		}
+		secretPath = strings.TrimPrefix(secretPath, mountPath+"/")
+	}
+	if mountPath == "" {
+		mountPath = defaultSecretsMount
 	}
 
-	return nil
+	mount, ok := (*currentMounts)[mountPath]
+	if !ok {
+		log.Errorf("Can't find secrets mount '%s' for the secret '%s'", mountPath, secretPath)
+		return "", "", errors.New("Can't find secrets mount " + mountPath)
+	}
+	if mount.Type != "kv" && mount.Type != "generic" {
+		log.Errorf("Mount '%s' of type '%s' can't hold generic secrets", mountPath, mount.Type)
+		return "", "", errors.New("Not a KV mount " + mountPath)
+	}
+
+	return mountPath, secretPath, nil
 }
 
-func (vault *vaultClient) SetSecret(secret *genericSecret) error {
+// GetKvMount detects the version of the KV engine mounted at the path.
+// The prune mode can be declared on the mount in the rules.
+func (vault *vaultClient) GetKvMount(mounts *map[string]mountInfo, mountPath string) (*kvMount, error) {
+	currentMounts, err := vault.ListMounts()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := (*currentMounts)[mountPath]; !ok {
+		log.Errorf("Can't find secrets mount '%s'", mountPath)
+		return nil, errors.New("Can't find secrets mount " + mountPath)
+	}
+
+	return newKvMount(mounts, currentMounts, mountPath), nil
+}
+
+func newKvMount(mounts *map[string]mountInfo, currentMounts *map[string]mountInfo, mountPath string) *kvMount {
+	kv := kvMount{
+		Path:    mountPath,
+		Version: 1,
+		Prune:   kvPruneDelete,
+	}
+	if (*currentMounts)[mountPath].Options["version"] == "2" {
+		kv.Version = 2
+	}
+	if mounts != nil {
+		if mount, ok := (*mounts)[mountPath]; ok && mount.Prune != "" {
+			kv.Prune = mount.Prune
+		}
+	}
+	log.Debugf("Secrets mount '%s' is KV version %d", kv.Path, kv.Version)
+
+	return &kv
+}
+
+func (vault *vaultClient) SetSecret(kv *kvMount, secret *genericSecret) error {
+	secretPath := kv.dataPath(secret.Path)
+	if kv.Version == 1 && secret.Metadata != nil {
+		log.Warningf("Secrets mount '%s' is KV version 1. Ignoring metadata of '%s'", kv.Path, secret.Path)
+	}
+
+	current, version, err := vault.ReadSecret(kv, secret.Path)
+	if err != nil {
+		return err
+	}
+
 	data := make(map[string]interface{})
+	generatedKeys := []string{}
 	for _, kpair := range secret.Fields {
-		data[kpair.Key] = kpair.Value
+		if kpair.Generate == nil {
+			data[kpair.Key] = toJSONValue(kpair.Value)
+			continue
+		}
+		// Generated values are created once and are never a drift
+		if currentValue, ok := current[kpair.Key]; ok {
+			data[kpair.Key] = currentValue
+			continue
+		}
+		value, err := kpair.Generate.generate()
+		if err != nil {
+			log.Errorf("Failed to generate '%s' for the secret '%s'", kpair.Key, secretPath)
+			return err
+		}
+		data[kpair.Key] = value
+		generatedKeys = append(generatedKeys, kpair.Key)
+	}
+
+	action := actionCreated
+	changedKeys := []string{}
+	if current != nil {
+		action = actionUpdated
+		switch secret.Mode {
+		case secretModeCreateOnly:
+			// Seeded once, owned by somebody else afterwards
+			data = current
+		case secretModeMerge:
+			// Only the declared fields are ours. The rest of the fields are kept as is.
+			changedKeys = diffSecretFields(data, current, false)
+			merged := make(map[string]interface{}, len(current)+len(data))
+			for key, value := range current {
+				merged[key] = value
+			}
+			for key, value := range data {
+				merged[key] = value
+			}
+			data = merged
+		default:
+			changedKeys = diffSecretFields(data, current, true)
+		}
+	}
+
+	if current != nil && len(changedKeys) == 0 {
+		log.Debugf("Secret '%s' is up to date", secretPath)
+		vault.summary.record("secret", filepath.Join(kv.Path, secret.Path), actionUnchanged)
+	} else {
+		// Values are never logged, only the names of the changed keys
+		log.Infof("Writing secret '%s' %v", secretPath, changedKeys)
+		if err := vault.writeSecret(kv, secret.Path, data, version); err != nil {
+			return err
+		}
+		if len(generatedKeys) > 0 {
+			vault.summary.record("secret", filepath.Join(kv.Path, secret.Path), actionGenerated, generatedKeys...)
+		}
+		if current != nil || len(generatedKeys) < len(data) {
+			vault.summary.record("secret", filepath.Join(kv.Path, secret.Path), action, changedKeys...)
+		}
+	}
+
+	if kv.Version == 2 && secret.Metadata != nil {
+		return vault.reconcileSecretMetadata(kv, secret)
 	}
-	_, err := vault.Client.Logical().Write(secret.Path, data)
+
+	return nil
+}
+
+// writeSecret writes the secret. For the KV version 2 the write is a check-and-set against the
+// version the secret was read at, so a concurrent writer is never clobbered.
+func (vault *vaultClient) writeSecret(kv *kvMount, path string, data map[string]interface{}, version int) error {
+	secretPath := kv.dataPath(path)
+	if kv.Version == 2 {
+		if version == 0 {
+			// The latest version might be deleted and can't be read
+			currentVersion, err := vault.getSecretVersion(kv, path)
+			if err != nil {
+				return err
+			}
+			version = currentVersion
+		}
+		data = map[string]interface{}{
+			"data": data,
+			"options": map[string]interface{}{
+				"cas": version,
+			},
+		}
+	}
+
+	_, err := vault.Client.Logical().Write(secretPath, data)
 	if err != nil {
-		log.Fatalf("Failed to set secret '%s'. %#v", secret.Path, err)
+		log.Errorf("Failed to set secret '%s'. %v", secretPath, err)
 		return err
 	}
-	log.Infof("Created secret '%s'", secret.Path)
+	return nil
+}
+
+// ReadSecret returns the current fields and version of the secret or nil if the secret doesn't exist
+func (vault *vaultClient) ReadSecret(kv *kvMount, path string) (map[string]interface{}, int, error) {
+	secretPath := kv.dataPath(path)
+	secret, err := vault.Client.Logical().Read(secretPath)
+	if err != nil {
+		log.Errorf("Failed to read secret '%s'. %v", secretPath, err)
+		return nil, 0, err
+	}
+	if secret == nil {
+		return nil, 0, nil
+	}
+	if kv.Version == 2 {
+		// Soft-deleted and destroyed versions come back without data
+		data := getStringMapInterfaceFromMap(&secret.Data, "data", nil)
+		if data == nil {
+			return nil, 0, nil
+		}
+		version := getIntFromMap(getStringMapInterfaceFromMap(&secret.Data, "metadata", nil), "version", 0)
+		return *data, version, nil
+	}
+	return secret.Data, 0, nil
+}
+
+// diffSecretFields returns the names of the changed, added and removed fields.
+// Unlike the config properties, secret values are compared with their types (ex: "60", 60 and "1m" are different secrets).
+func diffSecretFields(desired map[string]interface{}, current map[string]interface{}, includeRemoved bool) []string {
+	changed := []string{}
+	for key, value := range desired {
+		currentValue, ok := current[key]
+		if !ok || !typedValuesEqual(value, currentValue) {
+			changed = append(changed, key)
+		}
+	}
+	if includeRemoved {
+		for key := range current {
+			if _, ok := desired[key]; !ok {
+				changed = append(changed, key)
+			}
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func (vault *vaultClient) getSecretVersion(kv *kvMount, secretPath string) (int, error) {
+	metadata, err := vault.Client.Logical().Read(kv.metadataPath(secretPath))
+	if err != nil {
+		log.Errorf("Failed to read metadata of secret '%s'. %v", secretPath, err)
+		return 0, err
+	}
+	if metadata == nil {
+		return 0, nil
+	}
+	return getIntFromMap(&metadata.Data, "current_version", 0), nil
+}
+
+// isSecretDeleted tells if the current version of a KV version 2 secret is deleted or destroyed
+func (vault *vaultClient) isSecretDeleted(kv *kvMount, secretPath string) (bool, error) {
+	metadata, err := vault.Client.Logical().Read(kv.metadataPath(secretPath))
+	if err != nil {
+		log.Errorf("Failed to read metadata of secret '%s'. %v", secretPath, err)
+		return false, err
+	}
+	if metadata == nil {
+		return false, nil
+	}
+	currentVersion := getStringFromMap(&metadata.Data, "current_version", "")
+	versions := getStringMapInterfaceFromMap(&metadata.Data, "versions", nil)
+	if versions == nil {
+		return false, nil
+	}
+	version, ok := (*versions)[currentVersion].(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+	return getStringFromMap(&version, "deletion_time", "") != "" || getBoolFromMap(&version, "destroyed", false), nil
+}
+
+func (vault *vaultClient) reconcileSecretMetadata(kv *kvMount, secret *genericSecret) error {
+	metadataPath := kv.metadataPath(secret.Path)
+	desired := map[string]interface{}{
+		"max_versions": secret.Metadata.MaxVersions,
+		"cas_required": secret.Metadata.CasRequired,
+	}
+	if secret.Metadata.DeleteVersionAfter != "" {
+		desired["delete_version_after"] = secret.Metadata.DeleteVersionAfter
+	}
+	if secret.Metadata.CustomMetadata != nil {
+		desired["custom_metadata"] = secret.Metadata.CustomMetadata
+	}
+
+	current, err := vault.Client.Logical().Read(metadataPath)
+	if err != nil {
+		log.Errorf("Failed to read metadata '%s'. %v", metadataPath, err)
+		return err
+	}
+	keys := []string{}
+	if current != nil {
+		keys = diffProperties(desired, current.Data, false)
+		if len(keys) == 0 {
+			log.Debugf("Metadata '%s' is up to date", metadataPath)
+			return nil
+		}
+	}
+
+	log.Infof("Updating metadata '%s' %v", metadataPath, keys)
+	if _, err := vault.Client.Logical().Write(metadataPath, desired); err != nil {
+		log.Errorf("Failed to write metadata '%s'. %v", metadataPath, err)
+		return err
+	}
+	vault.summary.record("secret metadata", metadataPath, actionUpdated, keys...)
 
 	return nil
 }
 
 func (vault *vaultClient) ListSecrets() (secretsList *map[string]interface{}, err error) {
+	return vault.ListMountSecrets(defaultSecretsMount)
+}
+
+func (vault *vaultClient) ListMountSecrets(mountPath string) (secretsList *map[string]interface{}, err error) {
+	kv, err := vault.GetKvMount(nil, mountPath)
+	if err != nil {
+		return nil, err
+	}
+	return vault.listKvSecrets(kv)
+}
+
+func (vault *vaultClient) listKvSecrets(kv *kvMount) (secretsList *map[string]interface{}, err error) {
 	m := make(map[string]interface{})
 	secretsList = &m
-	err = vault.listSecrets("secret", secretsList)
+	err = vault.listSecrets(kv, "", secretsList)
 	log.Debugf("Found list of secrets: %v", *secretsList)
 	return secretsList, err
 }
 
-func (vault *vaultClient) listSecrets(path string, result *map[string]interface{}) error {
-	log.Debug("Listing secrets path: " + path)
-	list, err := vault.Client.Logical().List(path)
+func (vault *vaultClient) listSecrets(kv *kvMount, path string, result *map[string]interface{}) error {
+	log.Debug("Listing secrets path: " + kv.listPath(path))
+	list, err := vault.Client.Logical().List(kv.listPath(path))
 	if err != nil {
 		log.Errorf("Failed to list secrets. %v", err)
 		return err
@@ -87,14 +491,10 @@ func (vault *vaultClient) listSecrets(path string, result *map[string]interface{
 	keys := getStringArrayFromMap(&list.Data, "keys", []string{})
 	log.Debugf("Found %v secrets", keys)
 	for _, k := range keys {
-		separator := ""
-		if path[len(path)-1:] != "/" {
-			separator = "/"
-		}
-		fullSecretPath := path + separator + k
+		fullSecretPath := strings.TrimPrefix(path+"/"+k, "/")
 		log.Debug("Secret path: " + fullSecretPath)
 		if k[len(k)-1] == '/' {
-			vault.listSecrets(fullSecretPath, result)
+			vault.listSecrets(kv, strings.TrimSuffix(fullSecretPath, "/"), result)
 		} else {
 			(*result)[fullSecretPath] = nil
 		}
@@ -102,8 +502,15 @@ func (vault *vaultClient) listSecrets(path string, result *map[string]interface{
 	return nil
 }
 
-func (vault *vaultClient) DeleteSecret(path string) error {
-	log.Debug("Deleting secret at path: " + path)
-	_, err := vault.Client.Logical().Delete(path)
+func (vault *vaultClient) DeleteSecret(kv *kvMount, path string) error {
+	deletePath := kv.dataPath(path)
+	if kv.Version == 2 && kv.Prune == kvPruneDestroy {
+		deletePath = kv.metadataPath(path)
+	}
+	log.Debug("Deleting secret at path: " + deletePath)
+	_, err := vault.Client.Logical().Delete(deletePath)
+	if err == nil {
+		vault.summary.record("secret", filepath.Join(kv.Path, path), actionDeleted)
+	}
 	return err
 }
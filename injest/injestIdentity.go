@@ -0,0 +1,468 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	identityEntityPath = "identity/entity/name"
+	identityGroupPath  = "identity/group/name"
+
+	identityGroupInternal = "internal"
+	identityGroupExternal = "external"
+)
+
+// Vault creates an entity named 'entity_<uuid>' on the first login that doesn't match an existing alias
+var autoCreatedEntityName = regexp.MustCompile(`^entity_[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// UpdateIdentity reconciles the entities and the groups by name. The aliases reference the auth backends by
+// their mount path which is resolved to the mount accessor of the backend.
+func (vault *vaultClient) UpdateIdentity(identity *identityConfig) error {
+	log.Debug("Applying Identity")
+
+	authMounts, err := vault.ListAuthBackends()
+	if err != nil {
+		return err
+	}
+	accessors := map[string]string{}
+	for authPath, authMount := range *authMounts {
+		accessors[authPath] = authMount.Accessor
+	}
+
+	for _, group := range identity.Groups {
+		if group.Type == "" {
+			group.Type = identityGroupInternal
+		}
+		switch {
+		case group.Type != identityGroupInternal && group.Type != identityGroupExternal:
+			log.Errorf("Unknown type '%s' of the identity group '%s'", group.Type, group.Name)
+			return errors.New("Unknown identity group type " + group.Type)
+		case group.Type == identityGroupExternal && (len(group.MemberEntities) > 0 || len(group.MemberGroups) > 0):
+			log.Errorf("External identity group '%s' can't have members", group.Name)
+			return errors.New("External identity group with members " + group.Name)
+		case group.Type == identityGroupInternal && group.Alias != nil:
+			log.Errorf("Internal identity group '%s' can't have an alias", group.Name)
+			return errors.New("Internal identity group with alias " + group.Name)
+		}
+	}
+
+	if err := vault.updateIdentityEntities(identity, accessors); err != nil {
+		return err
+	}
+	return vault.updateIdentityGroups(identity, accessors)
+}
+
+func resolveAliasAccessor(accessors map[string]string, alias *identityAlias) (string, error) {
+	mount := strings.Trim(alias.Mount, "/")
+	accessor, ok := accessors[mount]
+	if !ok || accessor == "" {
+		log.Errorf("Auth backend '%s' of the identity alias '%s' is not mounted", mount, alias.Name)
+		return "", errors.New("Unknown auth backend " + mount)
+	}
+	return accessor, nil
+}
+
+func (vault *vaultClient) updateIdentityEntities(identity *identityConfig, accessors map[string]string) error {
+	currentEntities, err := vault.listIdentityNames(identityEntityPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entity := range identity.Entities {
+		entityPath := identityEntityPath + "/" + entity.Name
+		current, err := vault.readIdentity(entityPath)
+		if err != nil {
+			return err
+		}
+
+		desiredData := entity.toData()
+		if current == nil {
+			if _, err := vault.Client.Logical().Write(entityPath, desiredData); err != nil {
+				log.Errorf("Failed to create identity entity '%s'. %v", entity.Name, err)
+				return errors.New("Failed to create identity entity " + entity.Name)
+			}
+			vault.summary.record("identity entity", entityPath, actionCreated)
+			if current, err = vault.readIdentity(entityPath); err != nil || current == nil {
+				return errors.New("Failed to read identity entity " + entity.Name)
+			}
+		} else if changed := diffProperties(desiredData, identityEntityData(current), false); len(changed) > 0 {
+			log.Warningf("Identity entity '%s' is NOT identical in %v. Updating ...", entity.Name, changed)
+			if _, err := vault.Client.Logical().Write(entityPath, desiredData); err != nil {
+				log.Errorf("Failed to update identity entity '%s'. %v", entity.Name, err)
+				return errors.New("Failed to update identity entity " + entity.Name)
+			}
+			vault.summary.record("identity entity", entityPath, actionUpdated, changed...)
+		} else {
+			log.Debugf("Identity entity '%s' is identical. Skipping ...", entity.Name)
+			vault.summary.record("identity entity", entityPath, actionUnchanged)
+		}
+		delete(currentEntities, entity.Name)
+
+		if err := vault.updateEntityAliases(&entity, getStringFromMap(&current, "id", ""), current, accessors, identity.Prune); err != nil {
+			return err
+		}
+	}
+
+	// The entities Vault created on login are never pruned
+	for name := range currentEntities {
+		if autoCreatedEntityName.MatchString(name) {
+			log.Debugf("Keeping entity '%s' created by Vault on login", name)
+			delete(currentEntities, name)
+		}
+	}
+
+	return vault.pruneIdentity("identity entity", identityEntityPath, currentEntities, identity.Prune)
+}
+
+// updateEntityAliases creates the missing aliases of the entity and removes the ones that are not declared,
+// unless 'prune: none'
+func (vault *vaultClient) updateEntityAliases(entity *identityEntity, entityID string, current map[string]interface{}, accessors map[string]string, prune string) error {
+	currentAliases := map[string]string{}
+	if aliases, ok := current["aliases"].([]interface{}); ok {
+		for _, item := range aliases {
+			alias, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key := getStringFromMap(&alias, "mount_accessor", "") + "/" + getStringFromMap(&alias, "name", "")
+			currentAliases[key] = getStringFromMap(&alias, "id", "")
+		}
+	}
+
+	for _, alias := range entity.Aliases {
+		accessor, err := resolveAliasAccessor(accessors, &alias)
+		if err != nil {
+			return err
+		}
+		aliasPath := identityEntityPath + "/" + entity.Name + "/alias/" + strings.Trim(alias.Mount, "/") + "/" + alias.Name
+		key := accessor + "/" + alias.Name
+		if _, ok := currentAliases[key]; ok {
+			vault.summary.record("identity entity alias", aliasPath, actionUnchanged)
+			delete(currentAliases, key)
+			continue
+		}
+
+		data := map[string]interface{}{
+			"name":           alias.Name,
+			"canonical_id":   entityID,
+			"mount_accessor": accessor,
+		}
+		if _, err := vault.Client.Logical().Write("identity/entity-alias", data); err != nil {
+			log.Errorf("Failed to create alias '%s' of the identity entity '%s'. %v", alias.Name, entity.Name, err)
+			return errors.New("Failed to create identity entity alias " + alias.Name)
+		}
+		vault.summary.record("identity entity alias", aliasPath, actionCreated)
+	}
+
+	// Runaway aliases
+	keys := make([]string, 0, len(currentAliases))
+	for key := range currentAliases {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		aliasPath := identityEntityPath + "/" + entity.Name + "/alias/" + key
+		if prune == authPruneNone {
+			log.Infof("Keeping undeclared identity entity alias: %s", aliasPath)
+			vault.summary.record("identity entity alias", aliasPath, actionSkipped)
+			continue
+		}
+		log.Warningf("Found runaway identity entity alias: %s. Removing ...", aliasPath)
+		if _, err := vault.Client.Logical().Delete("identity/entity-alias/id/" + currentAliases[key]); err != nil {
+			log.Errorf("Failed to delete alias '%s' of the identity entity '%s'. %v", key, entity.Name, err)
+			return errors.New("Failed to delete identity entity alias " + key)
+		}
+		vault.summary.record("identity entity alias", aliasPath, actionDeleted)
+	}
+	return nil
+}
+
+func (vault *vaultClient) updateIdentityGroups(identity *identityConfig, accessors map[string]string) error {
+	currentGroups, err := vault.listIdentityNames(identityGroupPath)
+	if err != nil {
+		return err
+	}
+
+	// The groups can reference each other, so all of them have to exist before the members are resolved
+	groupIDs := map[string]string{}
+	created := map[string]bool{}
+	currentData := map[string]map[string]interface{}{}
+	for _, group := range identity.Groups {
+		groupPath := identityGroupPath + "/" + group.Name
+		current, err := vault.readIdentity(groupPath)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			groupType := group.Type
+			if groupType == "" {
+				groupType = identityGroupInternal
+			}
+			if _, err := vault.Client.Logical().Write(groupPath, map[string]interface{}{"type": groupType}); err != nil {
+				log.Errorf("Failed to create identity group '%s'. %v", group.Name, err)
+				return errors.New("Failed to create identity group " + group.Name)
+			}
+			vault.summary.record("identity group", groupPath, actionCreated)
+			if current, err = vault.readIdentity(groupPath); err != nil || current == nil {
+				return errors.New("Failed to read identity group " + group.Name)
+			}
+			created[group.Name] = true
+		}
+		groupIDs[group.Name] = getStringFromMap(&current, "id", "")
+		currentData[group.Name] = current
+	}
+
+	for _, group := range identity.Groups {
+		groupPath := identityGroupPath + "/" + group.Name
+		current := currentData[group.Name]
+
+		if group.Type != "" && group.Type != getStringFromMap(&current, "type", identityGroupInternal) {
+			log.Warningf("Type of the identity group '%s' can't be changed. Delete the group to recreate it", group.Name)
+		}
+
+		desiredData := group.toData()
+		entityIDs := []string{}
+		for _, name := range group.MemberEntities {
+			entity, err := vault.readIdentity(identityEntityPath + "/" + name)
+			if err != nil {
+				return err
+			}
+			if entity == nil {
+				log.Errorf("Member entity '%s' of the identity group '%s' doesn't exist", name, group.Name)
+				return errors.New("Unknown identity entity " + name)
+			}
+			entityIDs = append(entityIDs, getStringFromMap(&entity, "id", ""))
+		}
+		memberGroupIDs := []string{}
+		for _, name := range group.MemberGroups {
+			id, ok := groupIDs[name]
+			if !ok {
+				memberGroup, err := vault.readIdentity(identityGroupPath + "/" + name)
+				if err != nil {
+					return err
+				}
+				if memberGroup == nil {
+					log.Errorf("Member group '%s' of the identity group '%s' doesn't exist", name, group.Name)
+					return errors.New("Unknown identity group " + name)
+				}
+				id = getStringFromMap(&memberGroup, "id", "")
+			}
+			memberGroupIDs = append(memberGroupIDs, id)
+		}
+		if group.Type != identityGroupExternal {
+			desiredData["member_entity_ids"] = entityIDs
+			desiredData["member_group_ids"] = memberGroupIDs
+		}
+
+		changed := diffProperties(desiredData, identityGroupData(current), false)
+		if len(changed) > 0 {
+			if !created[group.Name] {
+				log.Warningf("Identity group '%s' is NOT identical in %v. Updating ...", group.Name, changed)
+			}
+			if _, err := vault.Client.Logical().Write(groupPath, desiredData); err != nil {
+				log.Errorf("Failed to update identity group '%s'. %v", group.Name, err)
+				return errors.New("Failed to update identity group " + group.Name)
+			}
+			if !created[group.Name] {
+				vault.summary.record("identity group", groupPath, actionUpdated, changed...)
+			}
+		} else if !created[group.Name] {
+			log.Debugf("Identity group '%s' is identical. Skipping ...", group.Name)
+			vault.summary.record("identity group", groupPath, actionUnchanged)
+		}
+		delete(currentGroups, group.Name)
+
+		if group.Type == identityGroupExternal {
+			if err := vault.updateGroupAlias(&group, groupIDs[group.Name], current, accessors, identity.Prune); err != nil {
+				return err
+			}
+		}
+	}
+
+	return vault.pruneIdentity("identity group", identityGroupPath, currentGroups, identity.Prune)
+}
+
+// updateGroupAlias maps the external group to the group of its auth backend. The undeclared alias is removed,
+// unless 'prune: none'.
+func (vault *vaultClient) updateGroupAlias(group *identityGroup, groupID string, current map[string]interface{}, accessors map[string]string, prune string) error {
+	currentAlias := getStringMapInterfaceFromMap(&current, "alias", &map[string]interface{}{})
+	currentID := getStringFromMap(currentAlias, "id", "")
+
+	if group.Alias == nil {
+		if currentID != "" {
+			aliasPath := identityGroupPath + "/" + group.Name + "/alias/" + getStringFromMap(currentAlias, "name", "")
+			if prune == authPruneNone {
+				log.Infof("Keeping undeclared identity group alias: %s", aliasPath)
+				vault.summary.record("identity group alias", aliasPath, actionSkipped)
+				return nil
+			}
+			log.Warningf("Found runaway identity group alias: %s. Removing ...", aliasPath)
+			if _, err := vault.Client.Logical().Delete("identity/group-alias/id/" + currentID); err != nil {
+				log.Errorf("Failed to delete alias of the identity group '%s'. %v", group.Name, err)
+				return errors.New("Failed to delete identity group alias " + group.Name)
+			}
+			vault.summary.record("identity group alias", aliasPath, actionDeleted)
+		}
+		return nil
+	}
+
+	accessor, err := resolveAliasAccessor(accessors, group.Alias)
+	if err != nil {
+		return err
+	}
+	aliasPath := identityGroupPath + "/" + group.Name + "/alias/" + strings.Trim(group.Alias.Mount, "/") + "/" + group.Alias.Name
+	data := map[string]interface{}{
+		"name":           group.Alias.Name,
+		"mount_accessor": accessor,
+		"canonical_id":   groupID,
+	}
+
+	if currentID == "" {
+		if _, err := vault.Client.Logical().Write("identity/group-alias", data); err != nil {
+			log.Errorf("Failed to create alias '%s' of the identity group '%s'. %v", group.Alias.Name, group.Name, err)
+			return errors.New("Failed to create identity group alias " + group.Alias.Name)
+		}
+		vault.summary.record("identity group alias", aliasPath, actionCreated)
+		return nil
+	}
+
+	changed := diffProperties(data, *currentAlias, false)
+	if len(changed) == 0 {
+		vault.summary.record("identity group alias", aliasPath, actionUnchanged)
+		return nil
+	}
+	log.Warningf("Alias of the identity group '%s' is NOT identical in %v. Updating ...", group.Name, changed)
+	if _, err := vault.Client.Logical().Write("identity/group-alias/id/"+currentID, data); err != nil {
+		log.Errorf("Failed to update alias '%s' of the identity group '%s'. %v", group.Alias.Name, group.Name, err)
+		return errors.New("Failed to update identity group alias " + group.Alias.Name)
+	}
+	vault.summary.record("identity group alias", aliasPath, actionUpdated, changed...)
+	return nil
+}
+
+// pruneIdentity removes the entities or the groups that are not declared in the rules
+func (vault *vaultClient) pruneIdentity(kind string, basePath string, runaway map[string]bool, prune string) error {
+	names := make([]string, 0, len(runaway))
+	for name := range runaway {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		identityPath := basePath + "/" + name
+		if prune == authPruneNone {
+			log.Infof("Keeping undeclared %s: %s", kind, identityPath)
+			vault.summary.record(kind, identityPath, actionSkipped)
+			continue
+		}
+		log.Warningf("Found runaway %s: %s. Removing ...", kind, identityPath)
+		if _, err := vault.Client.Logical().Delete(identityPath); err != nil {
+			log.Errorf("Failed to delete %s '%s'. %v", kind, name, err)
+			return errors.New("Failed to delete " + kind + " " + name)
+		}
+		vault.summary.record(kind, identityPath, actionDeleted)
+	}
+	return nil
+}
+
+// toData returns the properties of the entity as they are written to Vault
+func (entity *identityEntity) toData() map[string]interface{} {
+	metadata := entity.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	policies := entity.Policies
+	if policies == nil {
+		policies = []string{}
+	}
+	return map[string]interface{}{
+		"policies": policies,
+		"metadata": metadata,
+		"disabled": entity.Disabled,
+	}
+}
+
+// toData returns the properties of the group as they are written to Vault. The members are resolved separately.
+func (group *identityGroup) toData() map[string]interface{} {
+	metadata := group.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	policies := group.Policies
+	if policies == nil {
+		policies = []string{}
+	}
+	return map[string]interface{}{
+		"policies": policies,
+		"metadata": metadata,
+	}
+}
+
+// identityEntityData extracts the comparable properties of the entity read from Vault
+func identityEntityData(current map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"policies": getStringArrayFromMap(&current, "policies", []string{}),
+		"metadata": getStringMapFromStringMapInterface(*getStringMapInterfaceFromMap(&current, "metadata", &map[string]interface{}{})),
+		"disabled": getBoolFromMap(&current, "disabled", false),
+	}
+}
+
+// identityGroupData extracts the comparable properties of the group read from Vault
+func identityGroupData(current map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"policies":          getStringArrayFromMap(&current, "policies", []string{}),
+		"metadata":          getStringMapFromStringMapInterface(*getStringMapInterfaceFromMap(&current, "metadata", &map[string]interface{}{})),
+		"member_entity_ids": getStringArrayFromMap(&current, "member_entity_ids", []string{}),
+		"member_group_ids":  getStringArrayFromMap(&current, "member_group_ids", []string{}),
+	}
+}
+
+func (vault *vaultClient) listIdentityNames(basePath string) (map[string]bool, error) {
+	names := map[string]bool{}
+	result, err := vault.Client.Logical().List(basePath)
+	if err != nil {
+		log.Errorf("Failed to list %s. %v", basePath, err)
+		return names, err
+	}
+	if result == nil {
+		return names, nil
+	}
+
+	for _, name := range getStringArrayFromMap(&result.Data, "keys", []string{}) {
+		names[name] = true
+	}
+	log.Infof("Found %d entries in %s", len(names), basePath)
+	return names, nil
+}
+
+// readIdentity returns the entity or the group data or nil if it doesn't exist
+func (vault *vaultClient) readIdentity(identityPath string) (map[string]interface{}, error) {
+	result, err := vault.Client.Logical().Read(identityPath)
+	if err != nil {
+		log.Errorf("Failed to read %s. %v", identityPath, err)
+		return nil, err
+	}
+	if result == nil || result.Data == nil {
+		return nil, nil
+	}
+	return result.Data, nil
+}
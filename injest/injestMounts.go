@@ -19,6 +19,7 @@ package injest
 import (
 	"config2vault/log"
 	"errors"
+	"strings"
 
 	vaultapi "github.com/hashicorp/vault/api"
 )
@@ -43,13 +44,19 @@ func (vault *vaultClient) UpdateMounts(mounts *[]mountInfo) error {
 			// Similar mount is present in the system
 			log.Info("Skipping mount: " + newMount.Type)
 			delete(*currentMounts, newMount.Path)
+
+			// Reconverge config for the existing mount
+			if err := vault.ApplyMountConfig(newMount, false); err != nil {
+				log.Errorf("Failed to reconfigure mount '%s'. %v", newMount.Path, err)
+				return err
+			}
 			continue
 		}
 
 		// TODO: update mount lease times if were changed since last creation
 		vault.AddMount(&newMount)
 
-		if err := vault.ApplyMountConfig(newMount); err != nil {
+		if err := vault.ApplyMountConfig(newMount, true); err != nil {
 			log.Errorf("Failed to configure new mount. %v", err)
 			log.Info("Unmounting ...")
 			if err := vault.Client.Sys().Unmount(newMount.Path); err != nil {
@@ -65,6 +72,7 @@ func (vault *vaultClient) UpdateMounts(mounts *[]mountInfo) error {
 		"cubbyhole": true,
 		"sys":       true,
 		"secret":    true,
+		"identity":  true,
 	}
 	for path := range *currentMounts {
 		if ignoreMounts[path] {
@@ -96,9 +104,60 @@ func (vault *vaultClient) ListMounts() (*map[string]mountInfo, error) {
 	}
 	log.Debugf("Found %d mounts", len(mounts))
 
+	mountOptions, err := vault.ListMountOptions()
+	if err != nil {
+		return nil, err
+	}
+	for mountPath, options := range mountOptions {
+		if mount, ok := vaultMounts[mountPath]; ok {
+			mount.Options = options
+			vaultMounts[mountPath] = mount
+		}
+	}
+
 	return &vaultMounts, nil
 }
 
+// ListMountOptions returns the options of every mount (ex: version of the KV engine) keyed by the mount path
+func (vault *vaultClient) ListMountOptions() (map[string]map[string]string, error) {
+	r := vault.Client.NewRequest("GET", "/v1/sys/mounts")
+	resp, err := vault.Client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		log.Errorf("Can't get Vault mounts. %v", err)
+		return nil, err
+	}
+
+	var result map[string]interface{}
+	if err := resp.DecodeJSON(&result); err != nil {
+		log.Errorf("Can't parse Vault mounts. %v", err)
+		return nil, err
+	}
+	// Newer versions of Vault wrap the mounts into the 'data' section
+	if data, ok := result["data"].(map[string]interface{}); ok {
+		result = data
+	}
+
+	mountOptions := map[string]map[string]string{}
+	for mountPath, mount := range result {
+		mountData, ok := mount.(map[string]interface{})
+		if !ok || !strings.HasSuffix(mountPath, "/") {
+			continue
+		}
+		options := map[string]string{}
+		if optionsData, ok := mountData["options"].(map[string]interface{}); ok {
+			for key := range optionsData {
+				options[key] = getStringFromMap(&optionsData, key, "")
+			}
+		}
+		mountOptions[TrimSuffix(mountPath, "/")] = options
+	}
+
+	return mountOptions, nil
+}
+
 func (vault *vaultClient) AddMount(mount *mountInfo) error {
 	newMountInfo := vaultapi.MountInput{
 		Type:        mount.Type,
@@ -110,6 +169,24 @@ func (vault *vaultClient) AddMount(mount *mountInfo) error {
 	}
 	log.Infof("Adding new mount of type '%s' at path '%s'.", mount.Type, mount.Path)
 
+	if len(mount.Options) > 0 {
+		// The API client doesn't know about mount options (ex: KV version)
+		data := map[string]interface{}{
+			"type":        newMountInfo.Type,
+			"description": newMountInfo.Description,
+			"config": map[string]interface{}{
+				"default_lease_ttl": mount.DefaultLeaseTTL,
+				"max_lease_ttl":     mount.MaxLeaseTTL,
+			},
+			"options": mount.Options,
+		}
+		if _, err := vault.Client.Logical().Write("sys/mounts/"+mount.Path, data); err != nil {
+			log.Errorf("Failed to create a new mount. %v", err)
+			return errors.New("Failed to create a new mount")
+		}
+		return nil
+	}
+
 	if err := vault.Client.Sys().Mount(mount.Path, &newMountInfo); err != nil {
 		log.Errorf("Failed to create a new mount. %v", err)
 		return errors.New("Failed to create a new mount")
@@ -1 +1,68 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
 package injest
+
+import (
+	"config2vault/log"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pkiEngine imports the CA declared as a 'ca_bundle' config section
+type pkiEngine struct {
+	baseEngine
+}
+
+func (engine *pkiEngine) ApplyConfig(vault *vaultClient, mount *mountInfo, cfg map[string]interface{}, isNewMount bool) error {
+	ca_bundle_i, ok := cfg["ca_bundle"]
+	if !ok {
+		return engine.baseEngine.ApplyConfig(vault, mount, cfg, isNewMount)
+	}
+	configPath, ok := cfg["path"]
+	if !ok {
+		log.Error("Can't find 'path' property for config: " + mount.Path)
+		return nil
+	}
+	fullPath := path.Join(mount.Path, "config", fmt.Sprintf("%v", configPath))
+	log.Info("Configuring path: " + fullPath)
+
+	if ca_bundle_i == nil {
+		log.Error("Empty ca_bundle. Skipping ...")
+		return nil
+	}
+	ca_bundle, success := ca_bundle_i.(map[string]string)
+	if !success {
+		ca_bundle_ii, success := ca_bundle_i.(map[interface{}]interface{})
+		if !success {
+			log.Error("Can't parse ca_bundle. Skipping ...")
+			return nil
+		}
+		ca_bundle = getStringMapFromInterfaceMapInterface(ca_bundle_ii)
+	}
+	key, _ := GetContentEvenIfFile(ca_bundle["key"])
+	key = strings.TrimRight(key, "\n")
+	cert, _ := GetContentEvenIfFile(ca_bundle["cert"])
+	cert = strings.TrimRight(cert, "\n")
+	data := map[string]interface{}{
+		"pem_bundle": cert + "\n" + key,
+	}
+
+	// Re-importing a CA on every run would replace the CA of a live mount
+	writePolicy := getWritePolicy(cfg, writePolicyOnce)
+	return vault.reconcileConfigPath("mount config", fullPath, data, writePolicy, isNewMount)
+}
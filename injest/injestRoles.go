@@ -18,30 +18,47 @@ package injest
 
 import (
 	"config2vault/log"
-	"encoding/base64"
 	"errors"
-	"path/filepath"
+	"path"
+	"sort"
+	"strings"
 )
 
 func (vault *vaultClient) ApplyRolesToMounts(mountMap *map[string]mountInfo, roles *[]rolePolicy) error {
 	log.Debug("Applying roles")
 	existingRoles := map[string][]string{}
-
-	for _, mount := range (*mountMap) {
-		roles, _ := vault.ListRoles(mount)
-		log.Infof("Detected existing roles at '%s': %v", mount.Path, roles)
-		existingRoles[mount.Path] = roles
+	collectionMounts := map[string]mountInfo{}
+
+	for _, mount := range *mountMap {
+		handler := getEngineHandler(mount.Type)
+		for _, collectionPath := range listableRoleCollections(mount) {
+			roles, err := handler.ListRoles(vault, collectionPath)
+			if err != nil {
+				// The runaway roles of this collection are not pruned
+				continue
+			}
+			log.Infof("Detected existing roles at '%s': %v", collectionPath, roles)
+			existingRoles[collectionPath] = roles
+			collectionMounts[collectionPath] = mount
+		}
 	}
 
 	if vault.ApplyRoles(mountMap, roles, &existingRoles) != nil {
 		return errors.New("Failed to apply roles")
 	}
 
-	for mount, roles := range existingRoles {
+	collectionPaths := make([]string, 0, len(existingRoles))
+	for collectionPath := range existingRoles {
+		collectionPaths = append(collectionPaths, collectionPath)
+	}
+	sort.Strings(collectionPaths)
+
+	for _, collectionPath := range collectionPaths {
+		roles := existingRoles[collectionPath]
 		if len(roles) > 0 {
-			log.Warningf("For mount '%s' found runaway roles %v. Deleting ...", mount, roles)
-			if err := vault.DeleteRoles(mount, roles); err != nil {
-				log.Error("Failed to delete runaway roles from mount " + mount)
+			log.Warningf("For '%s' found runaway roles %v. Deleting ...", collectionPath, roles)
+			if err := vault.DeleteRoles(collectionMounts[collectionPath], collectionPath, roles); err != nil {
+				log.Error("Failed to delete runaway roles from " + collectionPath)
 				return err
 			}
 		}
@@ -56,37 +73,57 @@ func (vault *vaultClient) ApplyRoles(mounts *map[string]mountInfo, rolePolicies
 		return nil
 	}
 	for _, rolePol := range *rolePolicies {
-		newEntry := make(map[string]interface{})
-
-		rolePath := filepath.Join(rolePol.Path, "roles", rolePol.Name)
+		rolePol.Path = strings.Trim(rolePol.Path, "/")
+		mount, ok := (*mounts)[rolePol.Path]
+		if !ok {
+			log.Errorf("Mount '%s' of the role '%s' is not declared in 'mounts'", rolePol.Path, rolePol.Name)
+			return errors.New("Role mount is not declared: " + rolePol.Path)
+		}
+		handler := getEngineHandler(mount.Type)
+		collection, ok := findRoleCollection(handler, rolePol.Collection)
+		if !ok {
+			log.Errorf("Mount '%s' of type '%s' doesn't support '%s' roles", rolePol.Path, mount.Type, rolePol.Collection)
+			return errors.New("Unsupported roles on mount " + rolePol.Path)
+		}
+		collectionPath := path.Join(rolePol.Path, collection.Path)
+		rolePath := path.Join(collectionPath, rolePol.Name)
 
 		log.Infof("Preparing for role path '%s' policy %#v", rolePath, rolePol)
 
-		for propertyName, policyEntry := range rolePol.Properties {
-
-			policy, _ := GetContentEvenIfFile(policyEntry)
-			newEntry[propertyName] = policy
-
-			// If needed, encode for Consul
-			if (*mounts)[rolePol.Path].PolicyBase64Encode == true {
-				encoded := make([]byte, base64.StdEncoding.EncodedLen(len(policy)))
-				base64.StdEncoding.Encode(encoded, []byte(policy))
+		newEntry, err := handler.EncodeRole(&mount, collection, rolePol.Properties)
+		if err != nil {
+			return errors.New("Failed to load role properties for role path: " + rolePath)
+		}
 
-				newEntry[propertyName] = encoded
+		action := actionCreated
+		changed := []string{}
+		currentRole, err := handler.ReadRole(vault, rolePath)
+		switch {
+		case err != nil:
+			log.Warningf("Role '%s' can't be read back. Rewriting ...", rolePath)
+			action = actionUpdated
+		case currentRole != nil:
+			changed = handler.DescribeDrift(newEntry, currentRole)
+			if len(changed) == 0 {
+				log.Debugf("Role '%s' is identical. Skipping ...", rolePath)
+				action = actionUnchanged
+				break
 			}
+			log.Warningf("Role '%s' is NOT identical in %v. Updating ...", rolePath, changed)
+			for _, key := range changed {
+				log.Infof("  %s: %v => %v", key, currentRole[key], newEntry[key])
+			}
+			action = actionUpdated
 		}
 
-		log.Infof("Applying to role path '%s' role policy: %#v", rolePath, newEntry)
-		secret, err := vault.Client.Logical().Write(rolePath, newEntry)
-		if err != nil {
-			log.Error(err)
-			return errors.New("Failed to apply role policy to role path: " + rolePath)
-		}
-		if secret != nil {
-			log.Debugf("Received secret: %#v", *secret)
+		if action != actionUnchanged {
+			if err := handler.WriteRole(vault, rolePath, newEntry); err != nil {
+				return err
+			}
 		}
+		vault.summary.record("role", rolePath, action, changed...)
 
-		if pathRoles, ok := (*existingRoles)[rolePol.Path]; ok {
+		if pathRoles, ok := (*existingRoles)[collectionPath]; ok {
 			for i, roleName := range pathRoles {
 				if roleName == rolePol.Name {
 					// Delete item/element from slice
@@ -94,69 +131,42 @@ func (vault *vaultClient) ApplyRoles(mounts *map[string]mountInfo, rolePolicies
 					break
 				}
 			}
-			(*existingRoles)[rolePol.Path] = pathRoles
+			(*existingRoles)[collectionPath] = pathRoles
 		}
 	}
 
 	return nil
 }
 
-func (vault *vaultClient) ListRoles(mount mountInfo) (roles []string, err error) {
-	roles_path := filepath.Join(mount.Path, "roles")
-	log.Debug("Dumping roles at path " + roles_path)
-	secret, err := vault.Client.Logical().List(roles_path)
-	if err != nil {
-		// Note: Some secret backends do not implement this functionality
-		log.Info("Can't get list of roles at path: " + roles_path)
-		return roles, errors.New("Didn't get list of roles")
-	}
-
-	if secret != nil {
-		keys := secret.Data["keys"]
-		if keys != nil {
-			rolesData := keys.([]interface{})
-			for _, key := range rolesData {
-				roles = append(roles, key.(string))
-			}
-		}
-	}
-	return roles, nil
+// ListRoles returns the names of the roles in the collection (ex: 'pki/roles')
+func (vault *vaultClient) ListRoles(collectionPath string) ([]string, error) {
+	return defaultEngine.ListRoles(vault, collectionPath)
 }
 
-func (vault *vaultClient) DeleteRoles(mountPath string, roles []string) error {
+func (vault *vaultClient) DeleteRoles(mount mountInfo, collectionPath string, roles []string) error {
+	handler := getEngineHandler(mount.Type)
 	for _, role := range roles {
-		rolePath := filepath.Join(mountPath, "roles", role)
-
-		_, err := vault.Client.Logical().Delete(rolePath)
-		if err != nil {
-			log.Error("Failed to delete role " + rolePath)
-			return errors.New("Failed to delete role " + rolePath)
+		rolePath := path.Join(collectionPath, role)
+		if err := handler.DeleteRole(vault, rolePath); err != nil {
+			return err
 		}
 		log.Info("Deleted " + rolePath)
+		vault.summary.record("role", rolePath, actionDeleted)
 	}
 	return nil
 }
 
-func (vault *vaultClient) GetRole(mountPath string, roleId string) (*rolePolicy, error) {
-	rolePath := filepath.Join(mountPath, "roles", roleId)
-	log.Debugf("Reading role from path: %s", rolePath)
-	role, err := vault.Client.Logical().Read(rolePath)
-	if err != nil {
-		log.Error("Failed to get RoleID for Role: " + rolePath)
+// GetRole returns the role of the collection (ex: 'pki/roles') or nil if it doesn't exist
+func (vault *vaultClient) GetRole(collectionPath string, roleId string) (*rolePolicy, error) {
+	properties, err := defaultEngine.ReadRole(vault, path.Join(collectionPath, roleId))
+	if err != nil || properties == nil {
 		return nil, err
 	}
 
-	log.Debugf("Role content: %#v", role)
-
-	existingRole := rolePolicy{
-		Name: roleId,
-		Path: mountPath,
-	}
-
-	if role != nil && len(role.Data) > 0 {
-		existingRole.Properties = getStringMapFromStringMapInterface(role.Data)
-	}
-
-	return &existingRole, nil
-
-}
\ No newline at end of file
+	return &rolePolicy{
+		Name:       roleId,
+		Path:       path.Dir(collectionPath),
+		Collection: path.Base(collectionPath),
+		Properties: properties,
+	}, nil
+}
@@ -0,0 +1,310 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"bufio"
+	"bytes"
+	"config2vault/log"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	secretFormatDotenv     = "dotenv"
+	secretFormatJson       = "json"
+	secretFormatProperties = "properties"
+	secretFormatYaml       = "yaml"
+)
+
+var secretFormatExtensions = map[string]string{
+	".env":        secretFormatDotenv,
+	".json":       secretFormatJson,
+	".properties": secretFormatProperties,
+	".yml":        secretFormatYaml,
+	".yaml":       secretFormatYaml,
+}
+
+// expandSecretFiles loads the fields of the secrets that point to a file. A secret pointing to a folder is
+// expanded into one secret per file, named after the file without its extension.
+func expandSecretFiles(secrets []genericSecret) ([]genericSecret, error) {
+	result := make([]genericSecret, 0, len(secrets))
+	for _, secret := range secrets {
+		if secret.FromFile == "" {
+			result = append(result, secret)
+			continue
+		}
+
+		filename, _ := filepath.Abs(secret.FromFile)
+		fileInfo, err := os.Stat(filename)
+		if err != nil {
+			log.Error(err)
+			return nil, errors.New("Failed to load secret file " + secret.FromFile)
+		}
+
+		if !fileInfo.IsDir() {
+			fields, err := loadSecretFile(filename, secret.Format)
+			if err != nil {
+				return nil, err
+			}
+			secret.Fields = mergeSecretFields(fields, secret.Fields)
+			result = append(result, secret)
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filename)
+		if err != nil {
+			log.Error(err)
+			return nil, errors.New("Failed to read secrets folder " + secret.FromFile)
+		}
+		for _, file := range files {
+			if file.IsDir() || (strings.HasPrefix(file.Name(), ".") && file.Name() != ".env") {
+				continue
+			}
+			format := secret.Format
+			if format == "" {
+				if _, ok := secretFormatExtensions[filepath.Ext(file.Name())]; !ok {
+					log.Debugf("Skipping file %s", file.Name())
+					continue
+				}
+			}
+			fields, err := loadSecretFile(filepath.Join(filename, file.Name()), format)
+			if err != nil {
+				return nil, err
+			}
+			fileSecret := secret
+			fileSecret.Path = path.Join(secret.Path, secretNameFromFile(file.Name()))
+			fileSecret.Fields = mergeSecretFields(fields, secret.Fields)
+			result = append(result, fileSecret)
+		}
+	}
+	return result, nil
+}
+
+// secretNameFromFile strips the extension from the file name: "app.env" and ".env" give "app" and "env"
+func secretNameFromFile(name string) string {
+	if strings.HasPrefix(name, ".") {
+		return name[1:]
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// mergeSecretFields adds the fields declared in the rules to the fields loaded from a file. The declared ones win.
+func mergeSecretFields(loaded []fieldPair, declared []fieldPair) []fieldPair {
+	declaredKeys := map[string]bool{}
+	for _, field := range declared {
+		declaredKeys[field.Key] = true
+	}
+	result := []fieldPair{}
+	for _, field := range loaded {
+		if !declaredKeys[field.Key] {
+			result = append(result, field)
+		}
+	}
+	return append(result, declared...)
+}
+
+func loadSecretFile(filename string, format string) ([]fieldPair, error) {
+	if format == "" {
+		format = secretFormatExtensions[filepath.Ext(filename)]
+	}
+
+	log.Infof("Loading secret fields from file %s", filename)
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Error(err)
+		return nil, errors.New("Failed to load secret file " + filename)
+	}
+
+	var values map[string]interface{}
+	switch format {
+	case secretFormatDotenv:
+		values, err = parseDotenv(content)
+	case secretFormatProperties:
+		values, err = parseProperties(content)
+	case secretFormatJson:
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	case secretFormatYaml:
+		err = yaml.Unmarshal(content, &values)
+	default:
+		log.Errorf("Unknown format '%s' of the secret file %s", format, filename)
+		return nil, errors.New("Unknown secret file format " + format)
+	}
+	if err != nil {
+		log.Error(err)
+		return nil, errors.New("Failed to parse secret file " + filename)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([]fieldPair, 0, len(keys))
+	for _, key := range keys {
+		fields = append(fields, fieldPair{Key: key, Value: values[key]})
+	}
+	return fields, nil
+}
+
+// parseDotenv reads KEY=VALUE lines. The 'export' prefix, comments and quotes are supported.
+func parseDotenv(content []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		separator := strings.Index(line, "=")
+		if separator <= 0 {
+			return nil, errors.New("Invalid line in the .env file: " + line)
+		}
+		key := strings.TrimSpace(line[:separator])
+		value := strings.TrimSpace(line[separator+1:])
+
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			value = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1])
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			if comment := strings.Index(value, " #"); comment >= 0 {
+				value = strings.TrimSpace(value[:comment])
+			}
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// parseProperties reads Java properties: 'key=value', 'key: value' or 'key value' with '#' and '!' comments,
+// backslash line continuations and escapes ('\n', '\=', '\uXXXX', ...).
+func parseProperties(content []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	logical := ""
+	continued := false
+	for scanner.Scan() {
+		// The leading whitespace of a continued line is dropped too
+		line := strings.TrimLeft(scanner.Text(), " \t\f")
+		if !continued && (line == "" || line[0] == '#' || line[0] == '!') {
+			continue
+		}
+		// An odd number of trailing backslashes continues the line, '\\' is an escaped backslash
+		trailing := len(line) - len(strings.TrimRight(line, `\`))
+		continued = trailing%2 == 1
+		if continued {
+			logical += line[:len(line)-1]
+			continue
+		}
+		logical += line
+
+		key, value, err := splitProperty(logical)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+		logical = ""
+	}
+	if continued {
+		return nil, errors.New("Unterminated line continuation in the properties file")
+	}
+	return values, scanner.Err()
+}
+
+// splitProperty splits the logical line at the first unescaped separator and unescapes the key and the value
+func splitProperty(logical string) (string, string, error) {
+	keyEnd := len(logical)
+	for i := 0; i < len(logical); i++ {
+		if logical[i] == '\\' {
+			i++
+			continue
+		}
+		if strings.IndexByte("=: \t\f", logical[i]) >= 0 {
+			keyEnd = i
+			break
+		}
+	}
+
+	value := strings.TrimLeft(logical[keyEnd:], " \t\f")
+	if len(value) > 0 && (value[0] == '=' || value[0] == ':') {
+		value = strings.TrimLeft(value[1:], " \t\f")
+	}
+
+	key, err := unescapeProperty(logical[:keyEnd])
+	if err != nil {
+		return "", "", err
+	}
+	if value, err = unescapeProperty(value); err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+// unescapeProperty resolves the escapes of a key or a value. A backslash before any other character is dropped.
+func unescapeProperty(escaped string) (string, error) {
+	if !strings.Contains(escaped, `\`) {
+		return escaped, nil
+	}
+
+	var result bytes.Buffer
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != '\\' || i+1 == len(escaped) {
+			result.WriteByte(escaped[i])
+			continue
+		}
+		i++
+		switch escaped[i] {
+		case 't':
+			result.WriteByte('\t')
+		case 'n':
+			result.WriteByte('\n')
+		case 'r':
+			result.WriteByte('\r')
+		case 'f':
+			result.WriteByte('\f')
+		case 'u':
+			if i+5 > len(escaped) {
+				return "", errors.New("Malformed \\uXXXX escape in the properties file: " + escaped)
+			}
+			code, err := strconv.ParseUint(escaped[i+1:i+5], 16, 16)
+			if err != nil {
+				return "", errors.New("Malformed \\uXXXX escape in the properties file: " + escaped)
+			}
+			result.WriteRune(rune(code))
+			i += 4
+		default:
+			result.WriteByte(escaped[i])
+		}
+	}
+	return result.String(), nil
+}
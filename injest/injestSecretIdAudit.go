@@ -0,0 +1,116 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AuditSecretIds looks up every issued SecretID of the role and flags the ones without the required metadata,
+// without TTL or older than the allowed age. The flagged SecretIDs are destroyed if prune is set.
+func (vault *vaultClient) AuditSecretIds(appRole *appRoleProperties, prune bool) error {
+	audit := appRole.SecretIdAudit
+	if audit == nil {
+		audit = &secretIdAudit{}
+	}
+	var maxAge time.Duration
+	if audit.MaxAge != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(audit.MaxAge); err != nil {
+			log.Errorf("Invalid max_age '%s' of the AppRole '%s'", audit.MaxAge, appRole.Name)
+			return err
+		}
+	}
+
+	rolePath := path.Join("auth", appRole.Mount, "role", appRole.Name)
+	accessors, err := vault.ListSecretIdAccessors(appRole.Mount, appRole.Name)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Found %d SecretIDs of the AppRole '%s'", len(accessors), rolePath)
+
+	for _, accessor := range accessors {
+		secretId, err := vault.Client.Logical().Write(rolePath+"/secret-id-accessor/lookup", map[string]interface{}{
+			"secret_id_accessor": accessor,
+		})
+		if err != nil {
+			log.Errorf("Failed to lookup SecretID accessor '%s' of the AppRole '%s'. %v", accessor, rolePath, err)
+			return err
+		}
+		if secretId == nil {
+			continue
+		}
+
+		reasons := []string{}
+		metadata, _ := secretId.Data["metadata"].(map[string]interface{})
+		for _, key := range audit.RequiredMetadata {
+			if value, ok := metadata[key]; !ok || value == "" {
+				reasons = append(reasons, "missing metadata '"+key+"'")
+			}
+		}
+		if !audit.AllowNoTtl && getIntFromMap(&secretId.Data, "secret_id_ttl", 0) == 0 {
+			reasons = append(reasons, "no TTL")
+		}
+		if maxAge > 0 {
+			created, err := time.Parse(time.RFC3339Nano, getStringFromMap(&secretId.Data, "creation_time", ""))
+			if err == nil && time.Since(created) > maxAge {
+				reasons = append(reasons, "older than "+audit.MaxAge)
+			}
+		}
+		if len(reasons) == 0 {
+			continue
+		}
+
+		accessorPath := rolePath + "/secret-id-accessor/" + accessor
+		vault.summary.flag("SecretID", accessorPath, strings.Join(reasons, ", "))
+		if !prune {
+			continue
+		}
+
+		log.Warningf("Destroying SecretID '%s' ...", accessorPath)
+		_, err = vault.Client.Logical().Write(rolePath+"/secret-id-accessor/destroy", map[string]interface{}{
+			"secret_id_accessor": accessor,
+		})
+		if err != nil {
+			log.Errorf("Failed to destroy SecretID '%s'. %v", accessorPath, err)
+			return err
+		}
+		vault.summary.record("SecretID", accessorPath, actionDeleted)
+	}
+	return nil
+}
+
+// ListSecretIdAccessors returns the sorted accessors of the SecretIDs issued for the role
+func (vault *vaultClient) ListSecretIdAccessors(mount string, roleName string) ([]string, error) {
+	result, err := vault.Client.Logical().List(path.Join("auth", mount, "role", roleName, "secret-id"))
+	if err != nil {
+		log.Errorf("Failed to list SecretIDs of the AppRole '%s'. %v", roleName, err)
+		return nil, errors.New("Failed to list SecretIDs of " + roleName)
+	}
+	if result == nil {
+		return []string{}, nil
+	}
+
+	accessors := getStringArrayFromMap(&result.Data, "keys", []string{})
+	sort.Strings(accessors)
+	return accessors, nil
+}
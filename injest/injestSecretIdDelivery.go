@@ -0,0 +1,283 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	deliverToStdout = "stdout"
+	deliverToFile   = "file"
+	deliverToKv     = "kv"
+
+	defaultWrapTtl = "5m"
+)
+
+// wrapInfo is decoded from the raw response since the vendored API client doesn't know the wrapping accessor
+type wrapInfo struct {
+	Token        string `json:"token"`
+	Accessor     string `json:"accessor"`
+	TTL          int    `json:"ttl"`
+	CreationTime string `json:"creation_time"`
+}
+
+// deliveredSecretId is what the deploy pipeline gets: the RoleID and the response-wrapped SecretID
+type deliveredSecretId struct {
+	Mount            string `json:"mount"`
+	Role             string `json:"role"`
+	RoleId           string `json:"role_id"`
+	WrappingToken    string `json:"wrapping_token"`
+	WrappingAccessor string `json:"wrapping_accessor"`
+	WrapTtl          int    `json:"wrap_ttl"`
+	CreationTime     string `json:"creation_time"`
+}
+
+// IssueSecretId mints a new response-wrapped SecretID for the AppRole declared in the rules and delivers it
+// according to the 'deliver' section of the role. The role is referenced by its name or as 'mount/name'.
+func IssueSecretId(config *vaultConfig, roleName string) error {
+	vault, err := Reconnect()
+	if err != nil {
+		return errors.New("Can't create Vault client")
+	}
+
+	appRole, err := findAppRole(config, roleName)
+	if err != nil {
+		return err
+	}
+	if appRole.Deliver != nil && appRole.Deliver.To == deliverToKv {
+		if err := vault.checkKvDelivery(config, appRole.Deliver.KvPath); err != nil {
+			return err
+		}
+	}
+	return vault.IssueSecretId(appRole)
+}
+
+func findAppRole(config *vaultConfig, roleName string) (*appRoleProperties, error) {
+	found := []appRoleProperties{}
+	for _, appRole := range config.AppRoles {
+		if appRole.Mount == "" {
+			appRole.Mount = defaultAppRoleMount
+		}
+		appRole.Mount = strings.Trim(appRole.Mount, "/")
+		if appRole.Name == roleName || path.Join(appRole.Mount, appRole.Name) == roleName {
+			found = append(found, appRole)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		log.Errorf("Can't find AppRole '%s' in the rules", roleName)
+		return nil, errors.New("Unknown AppRole " + roleName)
+	case 1:
+		return &found[0], nil
+	}
+	log.Errorf("AppRole '%s' is declared on several mounts. Reference it as 'mount/name'", roleName)
+	return nil, errors.New("Ambiguous AppRole " + roleName)
+}
+
+func (vault *vaultClient) IssueSecretId(appRole *appRoleProperties) error {
+	deliver := appRole.Deliver
+	if deliver == nil {
+		deliver = &secretIdDelivery{}
+	}
+	to := deliver.To
+	if to == "" {
+		to = deliverToStdout
+	}
+	switch {
+	case to == deliverToFile && deliver.File == "":
+		return errors.New("Missing 'file' to deliver the SecretID of " + appRole.Name)
+	case to == deliverToKv && deliver.KvPath == "":
+		return errors.New("Missing 'kv_path' to deliver the SecretID of " + appRole.Name)
+	case to != deliverToStdout && to != deliverToFile && to != deliverToKv:
+		log.Errorf("Unknown delivery '%s' of the AppRole '%s'", to, appRole.Name)
+		return errors.New("Unknown SecretID delivery " + to)
+	}
+
+	roleId, err := vault.GetAppRoleID(appRole.Mount, appRole.Name)
+	if err != nil {
+		return err
+	}
+	if roleId == "" {
+		log.Errorf("AppRole '%s' doesn't exist in Vault. Apply the rules first", path.Join(appRole.Mount, appRole.Name))
+		return errors.New("Missing AppRole " + appRole.Name)
+	}
+
+	wrapInfo, err := vault.wrapAppRoleSecretID(appRole, deliver)
+	if err != nil {
+		return err
+	}
+
+	delivered := deliveredSecretId{
+		Mount:            appRole.Mount,
+		Role:             appRole.Name,
+		RoleId:           roleId,
+		WrappingToken:    wrapInfo.Token,
+		WrappingAccessor: wrapInfo.Accessor,
+		WrapTtl:          wrapInfo.TTL,
+		CreationTime:     wrapInfo.CreationTime,
+	}
+	log.Infof("Issued SecretID for the AppRole '%s' wrapped with accessor %s", appRole.Name, wrapInfo.Accessor)
+
+	switch to {
+	case deliverToFile:
+		return deliverSecretIdToFile(&delivered, deliver.File)
+	case deliverToKv:
+		return vault.deliverSecretIdToKv(&delivered, deliver.KvPath)
+	}
+	content, err := json.MarshalIndent(delivered, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(content))
+	return nil
+}
+
+// wrapAppRoleSecretID mints a SecretID with the metadata and the CIDR restrictions of the delivery.
+// Only the wrapping token leaves Vault, the SecretID itself is unwrapped by the application.
+func (vault *vaultClient) wrapAppRoleSecretID(appRole *appRoleProperties, deliver *secretIdDelivery) (*wrapInfo, error) {
+	data := map[string]interface{}{}
+	if len(deliver.Metadata) > 0 {
+		metadata, err := json.Marshal(deliver.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		data["metadata"] = string(metadata)
+	}
+	if len(deliver.CidrList) > 0 {
+		data["cidr_list"] = strings.Join(deliver.CidrList, ",")
+	}
+	if len(deliver.TokenBoundCidrs) > 0 {
+		data["token_bound_cidrs"] = strings.Join(deliver.TokenBoundCidrs, ",")
+	}
+
+	wrapTtl := deliver.WrapTtl
+	if wrapTtl == "" {
+		wrapTtl = defaultWrapTtl
+	}
+
+	r := vault.Client.NewRequest("POST", "/v1/"+path.Join("auth", appRole.Mount, "role", appRole.Name, "secret-id"))
+	r.WrapTTL = wrapTtl
+	if err := r.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+	resp, err := vault.Client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		log.Errorf("Failed to issue SecretID for the AppRole '%s'. %v", appRole.Name, err)
+		return nil, err
+	}
+
+	result := struct {
+		WrapInfo *wrapInfo `json:"wrap_info"`
+	}{}
+	if err := resp.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	if result.WrapInfo == nil {
+		return nil, errors.New("Vault didn't wrap the SecretID of " + appRole.Name)
+	}
+	return result.WrapInfo, nil
+}
+
+func deliverSecretIdToFile(delivered *deliveredSecretId, file string) error {
+	content, err := json.MarshalIndent(delivered, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename, _ := filepath.Abs(file)
+	if err := ioutil.WriteFile(filename, content, 0600); err != nil {
+		log.Errorf("Failed to write SecretID to '%s'. %v", filename, err)
+		return err
+	}
+	log.Infof("Delivered SecretID to %s", filename)
+	return nil
+}
+
+// checkKvDelivery refuses to deliver to a KV mount whose secrets are managed by the rules. The next apply would
+// prune the delivered secret, unless the mount has 'prune: none'.
+func (vault *vaultClient) checkKvDelivery(config *vaultConfig, kvPath string) error {
+	currentMounts, err := vault.ListMounts()
+	if err != nil {
+		return err
+	}
+	mountPath, _, err := resolveSecretMount(&genericSecret{Path: kvPath}, currentMounts)
+	if err != nil {
+		return err
+	}
+
+	// Same rule as UpdateGenericSecrets: the default mount and the mounts with declared secrets are pruned
+	managed := mountPath == defaultSecretsMount
+	for _, secret := range config.Secrets {
+		if secretMount, _, err := resolveSecretMount(&secret, currentMounts); err == nil && secretMount == mountPath {
+			managed = true
+		}
+	}
+	if !managed {
+		return nil
+	}
+
+	mounts := map[string]mountInfo{}
+	for _, mount := range config.Mounts {
+		if mount.Path == "" {
+			mount.Path = mount.Type
+		}
+		mounts[strings.Trim(mount.Path, "/")] = mount
+	}
+	if newKvMount(&mounts, currentMounts, mountPath).Prune == kvPruneNone {
+		return nil
+	}
+	log.Errorf("Secrets of the mount '%s' are pruned on apply. Set 'prune: none' on the mount to deliver to '%s'", mountPath, kvPath)
+	return errors.New("SecretID delivery to a pruned KV mount " + mountPath)
+}
+
+// deliverSecretIdToKv stores the delivery in a KV secret. An absolute path starts from the mount,
+// otherwise the secret is stored on the default 'secret' mount.
+func (vault *vaultClient) deliverSecretIdToKv(delivered *deliveredSecretId, kvPath string) error {
+	currentMounts, err := vault.ListMounts()
+	if err != nil {
+		return err
+	}
+	mountPath, secretPath, err := resolveSecretMount(&genericSecret{Path: kvPath}, currentMounts)
+	if err != nil {
+		return err
+	}
+	kv := newKvMount(nil, currentMounts, mountPath)
+
+	data := map[string]interface{}{
+		"role_id":           delivered.RoleId,
+		"wrapping_token":    delivered.WrappingToken,
+		"wrapping_accessor": delivered.WrappingAccessor,
+		"wrap_ttl":          delivered.WrapTtl,
+		"creation_time":     delivered.CreationTime,
+	}
+	if err := vault.writeSecret(kv, secretPath, data, 0); err != nil {
+		return err
+	}
+	log.Infof("Delivered SecretID to %s", path.Join(mountPath, secretPath))
+	return nil
+}
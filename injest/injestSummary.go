@@ -0,0 +1,108 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"strings"
+)
+
+const (
+	actionCreated   = "created"
+	actionUpdated   = "updated"
+	actionUnchanged = "unchanged"
+	actionSkipped   = "skipped"
+	actionDeleted   = "deleted"
+	actionGenerated = "generated"
+	actionReset     = "reset"
+)
+
+type changeRecord struct {
+	Kind   string
+	Path   string
+	Action string
+	Keys   []string
+}
+
+// auditFinding is a credential or a setting found in Vault that looks unexpected (ex: possible breach)
+type auditFinding struct {
+	Kind   string
+	Path   string
+	Reason string
+}
+
+// runSummary collects what every reconciliation step did to Vault during a single run
+type runSummary struct {
+	Changes  []changeRecord
+	Findings []auditFinding
+}
+
+func (summary *runSummary) record(kind string, path string, action string, keys ...string) {
+	summary.Changes = append(summary.Changes, changeRecord{
+		Kind:   kind,
+		Path:   path,
+		Action: action,
+		Keys:   keys,
+	})
+}
+
+func (summary *runSummary) flag(kind string, path string, reason string) {
+	summary.Findings = append(summary.Findings, auditFinding{
+		Kind:   kind,
+		Path:   path,
+		Reason: reason,
+	})
+}
+
+func (summary *runSummary) count(action string) int {
+	count := 0
+	for _, change := range summary.Changes {
+		if change.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+func (summary *runSummary) report() {
+	if len(summary.Findings) > 0 {
+		log.Warning("Audit findings:")
+		for _, finding := range summary.Findings {
+			log.Warningf("  %s '%s': %s", finding.Kind, finding.Path, finding.Reason)
+		}
+	}
+	if len(summary.Changes) == 0 {
+		return
+	}
+
+	log.Info("Run summary:")
+	for _, change := range summary.Changes {
+		if change.Action == actionUnchanged {
+			log.Debugf("  %-9s %s '%s'", change.Action, change.Kind, change.Path)
+			continue
+		}
+		if len(change.Keys) > 0 {
+			log.Infof("  %-9s %s '%s' (%s)", change.Action, change.Kind, change.Path, strings.Join(change.Keys, ", "))
+		} else {
+			log.Infof("  %-9s %s '%s'", change.Action, change.Kind, change.Path)
+		}
+	}
+	log.Infof("Created: %d, updated: %d, deleted: %d, generated: %d, reset: %d, unchanged: %d, skipped: %d",
+		summary.count(actionCreated), summary.count(actionUpdated), summary.count(actionDeleted),
+		summary.count(actionGenerated), summary.count(actionReset), summary.count(actionUnchanged),
+		summary.count(actionSkipped))
+}
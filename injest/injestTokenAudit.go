@@ -0,0 +1,189 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// tokenInfo is the classification of a token looked up by its accessor
+type tokenInfo struct {
+	Accessor string
+	Policies []string
+	Ttl      int
+	Orphan   bool
+	Path     string
+}
+
+// AuditTokens looks up every token by its accessor and flags the root tokens other than the one config2vault
+// is using and the tokens with policies that are not declared in the rules. The flagged tokens are revoked
+// if revoke is set.
+func (vault *vaultClient) AuditTokens(policies *[]policyDefiniton, revoke bool) error {
+	// The policies built into Vault. The 'root' tokens are checked separately.
+	declaredPolicies := map[string]bool{
+		"default":           true,
+		"response-wrapping": true,
+	}
+	for _, policy := range *policies {
+		declaredPolicies[policy.Name] = true
+	}
+
+	self, err := vault.Client.Auth().Token().LookupSelf()
+	if err != nil {
+		log.Errorf("Failed to lookup own token. %v", err)
+		return err
+	}
+	ownAccessor := getStringFromMap(&self.Data, "accessor", "")
+
+	accessors, err := vault.ListTokenAccessors()
+	if err != nil {
+		return err
+	}
+
+	byPath := map[string]int{}
+	orphans := 0
+	withoutTtl := 0
+	for _, accessor := range accessors {
+		token, err := vault.LookupTokenAccessor(accessor)
+		if err != nil {
+			return err
+		}
+		if token == nil {
+			// Expired in the meantime
+			continue
+		}
+
+		byPath[token.Path]++
+		if token.Orphan {
+			orphans++
+		}
+		if token.Ttl == 0 {
+			withoutTtl++
+		}
+
+		reasons := []string{}
+		undeclared := []string{}
+		for _, policy := range token.Policies {
+			if policy == "root" {
+				if accessor != ownAccessor {
+					reasons = append(reasons, "root token")
+				}
+				continue
+			}
+			if !declaredPolicies[policy] {
+				undeclared = append(undeclared, policy)
+			}
+		}
+		if len(undeclared) > 0 {
+			reasons = append(reasons, "undeclared policies "+strings.Join(undeclared, ", "))
+		}
+		if len(reasons) == 0 {
+			continue
+		}
+
+		accessorPath := "auth/token/accessors/" + accessor
+		vault.summary.flag("token", accessorPath, strings.Join(reasons, ", ")+" (created by "+token.Path+")")
+		if !revoke {
+			continue
+		}
+
+		log.Warningf("Revoking token '%s' ...", accessorPath)
+		if err := vault.Client.Auth().Token().RevokeAccessor(accessor); err != nil {
+			log.Errorf("Failed to revoke token '%s'. %v", accessorPath, err)
+			return err
+		}
+		vault.summary.record("token", accessorPath, actionDeleted)
+	}
+
+	paths := make([]string, 0, len(byPath))
+	for path := range byPath {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	log.Infof("Found %d tokens: %d orphan, %d without TTL", len(accessors), orphans, withoutTtl)
+	for _, path := range paths {
+		log.Infof("  %d created by '%s'", byPath[path], path)
+	}
+
+	return nil
+}
+
+func (vault *vaultClient) ListTokenAccessors() ([]string, error) {
+	result, err := vault.Client.Logical().List("auth/token/accessors")
+	if err != nil {
+		log.Errorf("Failed to list token accessors. %v", err)
+		return nil, errors.New("Failed to list token accessors")
+	}
+	if result == nil {
+		return []string{}, nil
+	}
+
+	accessors := getStringArrayFromMap(&result.Data, "keys", []string{})
+	sort.Strings(accessors)
+	return accessors, nil
+}
+
+// LookupTokenAccessor returns the token of the accessor or nil if the token doesn't exist anymore
+func (vault *vaultClient) LookupTokenAccessor(accessor string) (*tokenInfo, error) {
+	r := vault.Client.NewRequest("POST", "/v1/auth/token/lookup-accessor")
+	if err := r.SetJSONBody(map[string]interface{}{"accessor": accessor}); err != nil {
+		return nil, err
+	}
+	resp, err := vault.Client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		// Vault answers 400 Bad Request for an accessor whose token is gone (expired or revoked meanwhile)
+		if resp != nil && resp.StatusCode == http.StatusBadRequest {
+			return nil, nil
+		}
+		log.Errorf("Failed to lookup token accessor '%s'. %v", accessor, err)
+		return nil, err
+	}
+	secret, err := vaultapi.ParseSecret(resp.Body)
+	if err != nil {
+		log.Errorf("Failed to parse token accessor '%s'. %v", accessor, err)
+		return nil, err
+	}
+	if secret == nil {
+		return nil, nil
+	}
+
+	path := getStringFromMap(&secret.Data, "path", "")
+	if path == "" {
+		path = "unknown"
+	}
+	orphan := false
+	if value, ok := secret.Data["orphan"].(bool); ok {
+		orphan = value
+	}
+
+	return &tokenInfo{
+		Accessor: accessor,
+		Policies: getStringListFromMap(&secret.Data, "policies"),
+		Ttl:      getIntFromMap(&secret.Data, "ttl", 0),
+		Orphan:   orphan,
+		Path:     path,
+	}, nil
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"errors"
+	"sort"
+	"strings"
+)
+
+const tokenRolesPath = "auth/token/roles"
+
+// UpdateTokenRoles reconciles the declared token roles and removes the undeclared ones unless 'prune: none'
+func (vault *vaultClient) UpdateTokenRoles(tokenRoles *tokenRolesConfig) error {
+	log.Debug("Applying Token roles")
+	switch tokenRoles.Prune {
+	case "", authPruneDelete, authPruneNone:
+	default:
+		log.Errorf("Unknown prune mode '%s' of the token roles", tokenRoles.Prune)
+		return errors.New("Unknown prune mode " + tokenRoles.Prune)
+	}
+	if len(tokenRoles.Roles) == 0 {
+		log.Info("No Token roles to apply")
+	}
+
+	currentRoles, err := vault.ListTokenRoles()
+	if err != nil {
+		return err
+	}
+
+	for _, newRole := range tokenRoles.Roles {
+		rolePath := tokenRolesPath + "/" + newRole.Name
+		currentRole, err := vault.GetTokenRole(newRole.Name)
+		if err != nil {
+			return err
+		}
+
+		changed := []string{}
+		if currentRole != nil {
+			changed = currentRole.diff(&newRole)
+			if len(changed) == 0 {
+				log.Debugf("Token role '%s' is identical. Skipping ...", newRole.Name)
+				vault.summary.record("token role", rolePath, actionUnchanged)
+				delete(currentRoles, newRole.Name)
+				continue
+			}
+			log.Warningf("Token role '%s' is NOT identical in %v. Updating ...", newRole.Name, changed)
+		}
+
+		if _, err := vault.Client.Logical().Write(rolePath, newRole.toData()); err != nil {
+			log.Errorf("Failed to set token role '%s'. %v", newRole.Name, err)
+			return errors.New("Failed to set token role " + newRole.Name)
+		}
+		if currentRole != nil {
+			vault.summary.record("token role", rolePath, actionUpdated, changed...)
+		} else {
+			vault.summary.record("token role", rolePath, actionCreated)
+		}
+		delete(currentRoles, newRole.Name)
+	}
+
+	// Runaway roles
+	runaway := make([]string, 0, len(currentRoles))
+	for name := range currentRoles {
+		runaway = append(runaway, name)
+	}
+	sort.Strings(runaway)
+	for _, name := range runaway {
+		rolePath := tokenRolesPath + "/" + name
+		if tokenRoles.Prune == authPruneNone {
+			log.Infof("Keeping undeclared token role: %s", rolePath)
+			vault.summary.record("token role", rolePath, actionSkipped)
+			continue
+		}
+		log.Warningf("Found runaway token role: %s. Removing ...", rolePath)
+		if _, err := vault.Client.Logical().Delete(rolePath); err != nil {
+			log.Errorf("Failed to delete token role '%s'. %v", name, err)
+			return errors.New("Failed to delete token role " + name)
+		}
+		vault.summary.record("token role", rolePath, actionDeleted)
+	}
+
+	return nil
+}
+
+// toData returns the properties of the token role as they are written to Vault
+func (role *tokenRole) toData() map[string]interface{} {
+	renewable := true
+	if role.Renewable != nil {
+		renewable = *role.Renewable
+	}
+	data := map[string]interface{}{
+		"allowed_policies":    strings.Join(role.AllowedPolicies, ","),
+		"disallowed_policies": strings.Join(role.DisallowedPolicies, ","),
+		"orphan":              role.Orphan,
+		"period":              durationOrZero(role.Period),
+		"renewable":           renewable,
+		"explicit_max_ttl":    durationOrZero(role.ExplicitMaxTtl),
+		"path_suffix":         role.PathSuffix,
+	}
+	if len(role.BoundCidrs) > 0 {
+		data["bound_cidrs"] = []string(role.BoundCidrs)
+	}
+	return data
+}
+
+// diff returns the sorted list of properties of the current token role that differ from the desired role
+func (current *tokenRole) diff(desired *tokenRole) []string {
+	currentData := current.toData()
+	currentData["allowed_policies"] = current.AllowedPolicies
+	currentData["disallowed_policies"] = current.DisallowedPolicies
+	currentData["bound_cidrs"] = []string(current.BoundCidrs)
+
+	desiredData := desired.toData()
+	desiredData["allowed_policies"] = desired.AllowedPolicies
+	desiredData["disallowed_policies"] = desired.DisallowedPolicies
+	desiredData["bound_cidrs"] = []string(desired.BoundCidrs)
+
+	return diffProperties(desiredData, currentData, false)
+}
+
+func (vault *vaultClient) ListTokenRoles() (map[string]bool, error) {
+	roles := map[string]bool{}
+	result, err := vault.Client.Logical().List(tokenRolesPath)
+	if err != nil {
+		log.Errorf("Failed to list token roles. %v", err)
+		return roles, err
+	}
+	if result == nil {
+		return roles, nil
+	}
+
+	for _, name := range getStringArrayFromMap(&result.Data, "keys", []string{}) {
+		roles[name] = true
+	}
+	log.Infof("Found %d Token roles", len(roles))
+	return roles, nil
+}
+
+// GetTokenRole returns the token role or nil if it doesn't exist
+func (vault *vaultClient) GetTokenRole(name string) (*tokenRole, error) {
+	role, err := vault.Client.Logical().Read(tokenRolesPath + "/" + name)
+	if err != nil {
+		log.Errorf("Failed to read token role '%s'. %v", name, err)
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	// Newer Vault versions return the bound CIDRs as a token parameter
+	boundCidrs := getStringListFromMap(&role.Data, "bound_cidrs")
+	if _, ok := role.Data["bound_cidrs"]; !ok {
+		boundCidrs = getStringListFromMap(&role.Data, "token_bound_cidrs")
+	}
+	renewable := getBoolFromMap(&role.Data, "renewable", true)
+
+	return &tokenRole{
+		Name:               name,
+		AllowedPolicies:    getStringListFromMap(&role.Data, "allowed_policies"),
+		DisallowedPolicies: getStringListFromMap(&role.Data, "disallowed_policies"),
+		Orphan:             getBoolFromMap(&role.Data, "orphan", false),
+		Period:             getStringFromMap(&role.Data, "period", "0"),
+		Renewable:          &renewable,
+		ExplicitMaxTtl:     getStringFromMap(&role.Data, "explicit_max_ttl", "0"),
+		PathSuffix:         getStringFromMap(&role.Data, "path_suffix", ""),
+		BoundCidrs:         boundCidrs,
+	}, nil
+}
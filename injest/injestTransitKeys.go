@@ -18,42 +18,355 @@ package injest
 
 import (
 	"config2vault/log"
+	"encoding/json"
+	"errors"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
-func (vault *vaultClient) UpdateTransitKeys(transitKeys *[]transitKey) error {
-	log.Debug("Updating transit keys")
+const defaultTransitMount = "transit"
 
-	if len(*transitKeys) == 0 {
-		log.Info("No Transit Keys to injest")
-	} else {
-		for _, entry := range *transitKeys {
+// transitEngine manages the encryption keys of the transit mounts. The keys are declared in the 'keys' section of
+// the mount or in the top level 'transit_keys' section with the 'mount' of the key.
+type transitEngine struct {
+	baseEngine
+}
+
+type transitKey struct {
+	// Transit mount of the key. Defaults to 'transit'
+	Mount string `yaml:"mount,omitempty"`
+	Type  string `yaml:"type,omitempty"`
+	Name  string `yaml:"name"`
+	// Creation properties. Can't be changed after the key is created
+	Derived              bool `yaml:"derived,omitempty"`
+	ConvergentEncryption bool `yaml:"convergent_encryption,omitempty"`
+	// Key config. Exportable and allow_plaintext_backup can't be disabled once enabled
+	MinDecryptionVersion int  `yaml:"min_decryption_version,omitempty"`
+	MinEncryptionVersion int  `yaml:"min_encryption_version,omitempty"`
+	DeletionAllowed      bool `yaml:"deletion_allowed,omitempty"`
+	Exportable           bool `yaml:"exportable,omitempty"`
+	AllowPlaintextBackup bool `yaml:"allow_plaintext_backup,omitempty"`
+	// Rotate the key when its latest version is older than the period (ex: 720h)
+	RotateAfter string `yaml:"rotate_after,omitempty"`
+}
+
+// BindConfig attaches the keys of the 'transit_keys' section to their transit mounts
+func (engine *transitEngine) BindConfig(conf *vaultConfig) error {
+	boundKeys := map[string][]transitKey{}
+	for i := range conf.Mounts {
+		if conf.Mounts[i].Type == "transit" {
+			boundKeys[transitMountPath(&conf.Mounts[i])] = []transitKey{}
+		}
+	}
 
-			err := vault.UpdateTransitKey(&entry)
-			if err != nil {
-				return err
-			}
+	for _, entry := range conf.TransitKeys {
+		if entry.Mount == "" {
+			entry.Mount = defaultTransitMount
 		}
+		entry.Mount = strings.Trim(entry.Mount, "/")
+		if _, ok := boundKeys[entry.Mount]; !ok {
+			log.Errorf("Mount '%s' of the transit key '%s' is not declared in 'mounts' with type 'transit'", entry.Mount, entry.Name)
+			return errors.New("Unknown transit mount " + entry.Mount)
+		}
+		boundKeys[entry.Mount] = append(boundKeys[entry.Mount], entry)
 	}
 
+	for i := range conf.Mounts {
+		mount := &conf.Mounts[i]
+		if mount.Type != "transit" {
+			continue
+		}
+		if mount.Sections == nil {
+			mount.Sections = map[string]interface{}{}
+		}
+		mount.Sections["transit_keys"] = boundKeys[transitMountPath(mount)]
+	}
 	return nil
 }
 
+// ValidateMount checks the prune mode and the names of the declared keys
+func (engine *transitEngine) ValidateMount(mount *mountInfo) error {
+	if err := engine.baseEngine.ValidateMount(mount); err != nil {
+		return err
+	}
+
+	keys, err := engine.keys(mount)
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, key := range keys {
+		switch {
+		case key.Name == "":
+			log.Errorf("Transit key of the mount '%s' has no name", mount.Path)
+			return errors.New("Transit key without name on " + mount.Path)
+		case names[key.Name]:
+			log.Errorf("Transit key '%s' is declared twice on the mount '%s'", key.Name, mount.Path)
+			return errors.New("Duplicate transit key " + key.Name)
+		}
+		names[key.Name] = true
+	}
+	return nil
+}
+
+// ReconcileMount converges the declared keys of the mount. The unmanaged keys are removed if they allow deletion,
+// unless 'prune: none'.
+func (engine *transitEngine) ReconcileMount(vault *vaultClient, mount *mountInfo, isNewMount bool) error {
+	keys, err := engine.keys(mount)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		log.Infof("No Transit Keys to injest on '%s'", mount.Path)
+	}
+
+	managedKeys := map[string]bool{}
+	for _, key := range keys {
+		if err := vault.UpdateTransitKey(&key); err != nil {
+			return err
+		}
+		managedKeys[key.Name] = true
+	}
+
+	if isNewMount {
+		return nil
+	}
+	return vault.pruneTransitKeys(mount, managedKeys)
+}
+
+// keys returns the keys of the 'keys' section of the mount followed by the ones bound from 'transit_keys'
+func (engine *transitEngine) keys(mount *mountInfo) ([]transitKey, error) {
+	keys := []transitKey{}
+	for _, section := range []string{"keys", "transit_keys"} {
+		sectionKeys := []transitKey{}
+		if err := decodeMountSection(mount, section, &sectionKeys); err != nil {
+			return nil, err
+		}
+		keys = append(keys, sectionKeys...)
+	}
+	for i := range keys {
+		keys[i].Mount = transitMountPath(mount)
+	}
+	return keys, nil
+}
+
+func transitMountPath(mount *mountInfo) string {
+	if mount.Path == "" {
+		return mount.Type
+	}
+	return strings.Trim(mount.Path, "/")
+}
+
 func (vault *vaultClient) UpdateTransitKey(key *transitKey) error {
 
-	path := filepath.Join("transit/keys", key.Name)
-	log.Debugf("Creating transit key '%s'", path)
+	mount := key.Mount
+	if mount == "" {
+		mount = defaultTransitMount
+	}
+	path := filepath.Join(mount, "keys", key.Name)
+
+	current, err := vault.Client.Logical().Read(path)
+	if err != nil {
+		log.Errorf("Failed to read key '%s'. %v", path, err)
+		return err
+	}
+
+	if current == nil {
+		log.Debugf("Creating transit key '%s'", path)
+
+		data := make(map[string]interface{})
+		if key.Type != "" {
+			data["type"] = key.Type // defaults to: aes256-gcm96
+		}
+		if key.Derived {
+			data["derived"] = true
+		}
+		if key.ConvergentEncryption {
+			data["convergent_encryption"] = true
+		}
+		if key.Exportable {
+			data["exportable"] = true
+		}
+		if key.AllowPlaintextBackup {
+			data["allow_plaintext_backup"] = true
+		}
+
+		if _, err := vault.Client.Logical().Write(path, data); err != nil {
+			log.Errorf("Failed to create key '%s'. %v", key.Name, err)
+			return err
+		}
+		log.Infof("Created key '%s'", key.Name)
+		vault.summary.record("transit key", path, actionCreated)
+
+		if current, err = vault.Client.Logical().Read(path); err != nil || current == nil {
+			log.Errorf("Failed to read key '%s'. %v", path, err)
+			return errors.New("Failed to read transit key " + path)
+		}
+	} else {
+		vault.warnTransitKeyProperties(key, path, current.Data)
+	}
+
+	if err := vault.reconcileTransitKeyConfig(key, path, current.Data); err != nil {
+		return err
+	}
+
+	return vault.rotateTransitKey(key, path, current.Data)
+}
 
-	data := make(map[string]interface{})
+// warnTransitKeyProperties reports the creation properties that differ. Such a key has to be recreated manually.
+func (vault *vaultClient) warnTransitKeyProperties(key *transitKey, path string, current map[string]interface{}) {
+	desired := map[string]interface{}{
+		"derived":               key.Derived,
+		"convergent_encryption": key.ConvergentEncryption,
+	}
 	if key.Type != "" {
-		data["type"] = key.Type  // defaults to: aes256-gcm96
+		desired["type"] = key.Type
 	}
+	if changed := diffProperties(desired, current, true); len(changed) > 0 {
+		log.Warningf("Transit key '%s' differs in %v. These properties can't be changed after the key is created", path, changed)
+	}
+}
 
-	if _, err := vault.Client.Logical().Write(path, data); err != nil {
-		log.Fatalf("Failed to kreate key '%s'. %v", key.Name, err)
+func (vault *vaultClient) reconcileTransitKeyConfig(key *transitKey, path string, current map[string]interface{}) error {
+	desired := map[string]interface{}{
+		"deletion_allowed": key.DeletionAllowed,
+	}
+	// Older Vault versions don't know about min_encryption_version
+	if _, ok := current["min_encryption_version"]; ok || key.MinEncryptionVersion > 0 {
+		desired["min_encryption_version"] = key.MinEncryptionVersion
+	}
+	if key.MinDecryptionVersion > 0 {
+		desired["min_decryption_version"] = key.MinDecryptionVersion
+	}
+	// Exportable and allow_plaintext_backup can only be enabled
+	if key.Exportable {
+		desired["exportable"] = true
+	} else if getBoolFromMap(&current, "exportable", false) {
+		log.Warningf("Transit key '%s' is exportable. This can't be disabled", path)
+	}
+	if key.AllowPlaintextBackup {
+		desired["allow_plaintext_backup"] = true
+	} else if getBoolFromMap(&current, "allow_plaintext_backup", false) {
+		log.Warningf("Transit key '%s' allows plaintext backup. This can't be disabled", path)
+	}
+
+	changed := diffProperties(desired, current, false)
+	if len(changed) == 0 {
+		vault.summary.record("transit key config", path, actionUnchanged)
+		return nil
+	}
+
+	data := map[string]interface{}{}
+	for _, property := range changed {
+		data[property] = desired[property]
+	}
+	log.Infof("Updating config of the transit key '%s': %v", path, changed)
+	if _, err := vault.Client.Logical().Write(path+"/config", data); err != nil {
+		log.Errorf("Failed to configure key '%s'. %v", path, err)
+		return err
+	}
+	vault.summary.record("transit key config", path, actionUpdated, changed...)
+	return nil
+}
+
+// rotateTransitKey rotates the key when its latest version is older than the rotate_after period
+func (vault *vaultClient) rotateTransitKey(key *transitKey, path string, current map[string]interface{}) error {
+	if key.RotateAfter == "" {
+		return nil
+	}
+	period, err := time.ParseDuration(key.RotateAfter)
+	if err != nil {
+		log.Errorf("Invalid rotate_after '%s' of the transit key '%s'", key.RotateAfter, path)
 		return err
 	}
-	log.Infof("Created key '%s'", key.Name)
 
+	created, ok := transitKeyVersionCreated(current)
+	if !ok {
+		log.Warningf("Can't find the creation time of the latest version of the transit key '%s'", path)
+		return nil
+	}
+	if time.Since(created) < period {
+		return nil
+	}
+
+	log.Infof("Latest version of the transit key '%s' was created %s. Rotating ...", path, created.Format(time.RFC3339))
+	if _, err := vault.Client.Logical().Write(path+"/rotate", nil); err != nil {
+		log.Errorf("Failed to rotate key '%s'. %v", path, err)
+		return err
+	}
+	vault.summary.record("transit key", path, actionUpdated, "rotated")
+	return nil
+}
+
+// transitKeyVersionCreated returns the creation time of the latest key version. Symmetric keys report it as
+// a unix timestamp, asymmetric keys as a map with the 'creation_time'.
+func transitKeyVersionCreated(current map[string]interface{}) (time.Time, bool) {
+	latest := getStringFromMap(&current, "latest_version", "")
+	versions, ok := current["keys"].(map[string]interface{})
+	if !ok {
+		return time.Time{}, false
+	}
+
+	switch version := versions[latest].(type) {
+	case json.Number:
+		seconds, err := version.Int64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(seconds, 0), true
+	case map[string]interface{}:
+		created, err := time.Parse(time.RFC3339Nano, getStringFromMap(&version, "creation_time", ""))
+		if err != nil {
+			return time.Time{}, false
+		}
+		return created, true
+	}
+	return time.Time{}, false
+}
+
+// pruneTransitKeys removes the unmanaged keys that allow deletion and warns about the rest
+func (vault *vaultClient) pruneTransitKeys(mount *mountInfo, managedKeys map[string]bool) error {
+	secret, err := vault.Client.Logical().List(filepath.Join(mount.Path, "keys"))
+	if err != nil {
+		log.Errorf("Failed to list transit keys of '%s'. %v", mount.Path, err)
+		return err
+	}
+	if secret == nil {
+		return nil
+	}
+
+	keys := getStringArrayFromMap(&secret.Data, "keys", []string{})
+	sort.Strings(keys)
+	for _, name := range keys {
+		if managedKeys[name] {
+			continue
+		}
+		path := filepath.Join(mount.Path, "keys", name)
+		if mount.Prune == authPruneNone {
+			log.Infof("Keeping unmanaged transit key: %s", path)
+			vault.summary.record("transit key", path, actionSkipped)
+			continue
+		}
+
+		current, err := vault.Client.Logical().Read(path)
+		if err != nil {
+			log.Errorf("Failed to read key '%s'. %v", path, err)
+			return err
+		}
+		if current == nil || !getBoolFromMap(&current.Data, "deletion_allowed", false) {
+			log.Warningf("Found unmanaged transit key '%s'. Deletion is not allowed. Skipping ...", path)
+			vault.summary.record("transit key", path, actionSkipped)
+			continue
+		}
+
+		log.Warningf("Found unmanaged transit key '%s'. Removing ...", path)
+		if _, err := vault.Client.Logical().Delete(path); err != nil {
+			log.Errorf("Failed to delete key '%s'. %v", path, err)
+			return err
+		}
+		vault.summary.record("transit key", path, actionDeleted)
+	}
 	return nil
 }
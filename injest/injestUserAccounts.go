@@ -20,73 +20,224 @@ import (
 	"config2vault/log"
 	"errors"
 	"path"
+	"sort"
 	"strings"
-	//"io"
-	//"bytes"
 )
 
-func (vault *vaultClient) CreateUserAccounts(users []userAccount) error {
-	if len(users) == 0 {
+const (
+	defaultUserpassMount = "userpass"
+
+	passwordPolicyAlways  = "always"
+	passwordPolicySetOnce = "set_once"
+
+	authPruneDelete = "delete"
+	authPruneNone   = "none"
+)
+
+func (vault *vaultClient) CreateUserAccounts(authBackends *[]authBackendInfo, users []userAccount) error {
+	// Users of every declared userpass backend are managed
+	userpassBackends := map[string]authBackendInfo{}
+	for _, backend := range *authBackends {
+		if backend.Type == "userpass" {
+			userpassBackends[backend.Path] = backend
+		}
+	}
+	if len(users) == 0 && len(userpassBackends) == 0 {
 		return nil
 	}
 
 	log.Info("Creating User Accounts ...")
+	currentAccounts := map[string]map[string]*userAccount{}
 	for _, user := range users {
+		if user.Mount == "" {
+			user.Mount = defaultUserpassMount
+		}
+		user.Mount = strings.Trim(user.Mount, "/")
+		if _, ok := userpassBackends[user.Mount]; !ok {
+			log.Errorf("Auth backend '%s' of the user '%s' is not declared in 'auth' with type 'userpass'", user.Mount, user.Name)
+			return errors.New("Userpass auth backend is not mounted: " + user.Mount)
+		}
+		switch user.PasswordPolicy {
+		case "", passwordPolicyAlways, passwordPolicySetOnce:
+		default:
+			log.Errorf("Unknown password_policy '%s' of the user '%s'", user.PasswordPolicy, user.Name)
+			return errors.New("Unknown password policy " + user.PasswordPolicy)
+		}
+
+		existingUser, err := vault.isUserPresent(currentAccounts, &user)
+		if err != nil {
+			return err
+		}
+		if err := vault.SetUser(&user, existingUser); err != nil {
+			return err
+		}
+		account := user
+		currentAccounts[user.Mount][user.Name] = &account
+	}
+
+	mountPaths := make([]string, 0, len(userpassBackends))
+	for mountPath := range userpassBackends {
+		mountPaths = append(mountPaths, mountPath)
+	}
+	sort.Strings(mountPaths)
 
-		data := make(map[string]interface{})
-		if user.Policies != nil {
-			data["policies"] = strings.Join(user.Policies, ",")
+	for _, mountPath := range mountPaths {
+		if err := vault.pruneUsers(userpassBackends[mountPath], currentAccounts); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// SetUser creates the user or updates the policies and TTLs that differ from the existing user.
+// The password of an existing user is reset on its own, according to the password policy.
+func (vault *vaultClient) SetUser(user *userAccount, existingUser *userAccount) error {
+	ttl := user.Ttl
+	if ttl == "" {
+		ttl = "0"
+	}
+	maxTtl := user.MaxTtl
+	if maxTtl == "" {
+		maxTtl = "0"
+	}
+	data := map[string]interface{}{
+		"policies": strings.Join(user.Policies, ","),
+		"ttl":      ttl,
+		"max_ttl":  maxTtl,
+	}
+
+	path := path.Join("auth", user.Mount, "users", user.Name)
+	if existingUser == nil {
+		generated := false
 		if user.Password != "" {
 			data["password"] = user.Password
 		}
+		if user.GeneratePassword != nil {
+			// Generated password is set only when the user is created
+			password, err := user.GeneratePassword.generate()
+			if err != nil {
+				log.Errorf("Failed to generate password for user '%s'", user.Name)
+				return err
+			}
+			data["password"] = password
+			generated = true
+		}
 
-		path := path.Join("auth/userpass/users", user.Name)
-		log.Info("Creating/Updating user: " + path)
-		_, err := vault.Client.Logical().Write(path, data)
-		if err != nil {
+		log.Info("Creating user: " + path)
+		if _, err := vault.Client.Logical().Write(path, data); err != nil {
 			log.Errorf("Failed to create user '%s': %v", path, err)
 			return errors.New("Failed to create user: " + path)
 		}
+		vault.summary.record("user", path, actionCreated)
+		if generated {
+			vault.summary.record("user", path, actionGenerated, "password")
+		}
+		return nil
+	}
+
+	changed := []string{}
+	if !areEqual(user.Policies, existingUser.Policies, []string{"default", ""}) {
+		changed = append(changed, "policies")
+	}
+	if !valuesEqual(ttl, existingUser.Ttl) {
+		changed = append(changed, "ttl")
+	}
+	if !valuesEqual(maxTtl, existingUser.MaxTtl) {
+		changed = append(changed, "max_ttl")
+	}
+	if len(changed) > 0 {
+		log.Info("Updating user: " + path)
+		if _, err := vault.Client.Logical().Write(path, data); err != nil {
+			log.Errorf("Failed to update user '%s': %v", path, err)
+			return errors.New("Failed to update user: " + path)
+		}
+		vault.summary.record("user", path, actionUpdated, changed...)
+	}
+
+	// Vault never returns the password back, so it can only be reset or left alone
+	if user.Password != "" && user.PasswordPolicy != passwordPolicySetOnce {
+		log.Debug("Resetting password of user: " + path)
+		if _, err := vault.Client.Logical().Write(path+"/password", map[string]interface{}{"password": user.Password}); err != nil {
+			log.Errorf("Failed to reset password of user '%s': %v", path, err)
+			return errors.New("Failed to reset password of user: " + path)
+		}
+		vault.summary.record("user", path, actionReset, "password")
+	} else if len(changed) == 0 {
+		vault.summary.record("user", path, actionUnchanged)
 	}
 	return nil
 }
 
-func (vault *vaultClient) isUserPresent(currentAccounts *map[string]*map[string]*userAccount, newUser *userAccount) (*userAccount, error) {
-
-	// TODO: make this more generic
-	authPath := "userpass"
-	authPathAccounts, found := (*currentAccounts)[authPath]
-	if !found {
-		var err error
-		accountIDs, err := vault.ListUsers(authPath)
-		found := false
-		for _, id := range *accountIDs {
-			if id == newUser.Name {
-				found = true
-				break
-			}
+// pruneUsers removes the runaway users of the backend, or only reports them if the backend has 'prune: none'
+func (vault *vaultClient) pruneUsers(backend authBackendInfo, currentAccounts map[string]map[string]*userAccount) error {
+	accounts, err := vault.listCachedUsers(currentAccounts, backend.Path)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(accounts))
+	for name, account := range accounts {
+		if account == nil {
+			names = append(names, name)
 		}
-		if found {
-			log.Debug("Found existing user with the same name: " + newUser.Name)
-			_, err = vault.GetUser(newUser.Name)
+	}
+	sort.Strings(names)
 
-			if err != nil {
-				return nil, err
-			}
+	for _, name := range names {
+		path := path.Join("auth", backend.Path, "users", name)
+		if backend.Prune == authPruneNone {
+			log.Warning("Found runaway user: " + path)
+			vault.summary.record("user", path, actionSkipped)
+			continue
+		}
+		log.Warningf("Found runaway user: %s. Removing ...", path)
+		if _, err := vault.Client.Logical().Delete(path); err != nil {
+			log.Errorf("Failed to delete user '%s': %v", path, err)
+			return errors.New("Failed to delete user: " + path)
 		}
+		vault.summary.record("user", path, actionDeleted)
 	}
+	return nil
+}
 
-	if authPathAccounts != nil {
-		return (*authPathAccounts)[newUser.Name], nil
+// isUserPresent returns the existing user from Vault or nil if the user doesn't exist yet.
+// The users of every backend are listed once and are read from Vault only when requested.
+func (vault *vaultClient) isUserPresent(currentAccounts map[string]map[string]*userAccount, newUser *userAccount) (*userAccount, error) {
+	accounts, err := vault.listCachedUsers(currentAccounts, newUser.Mount)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := accounts[newUser.Name]; !found {
+		return nil, nil
+	}
+
+	log.Debug("Found existing user with the same name: " + newUser.Name)
+	return vault.GetUser(newUser.Mount, newUser.Name)
+}
+
+// listCachedUsers lists the users of the backend. The users declared in the rules are set while applying them.
+func (vault *vaultClient) listCachedUsers(currentAccounts map[string]map[string]*userAccount, authPath string) (map[string]*userAccount, error) {
+	if accounts, found := currentAccounts[authPath]; found {
+		return accounts, nil
+	}
+
+	accountIDs, err := vault.ListUsers(authPath)
+	if err != nil {
+		return nil, err
+	}
+	accounts := map[string]*userAccount{}
+	for _, id := range *accountIDs {
+		accounts[id] = nil
 	}
-	return nil, nil
+	currentAccounts[authPath] = accounts
+	return accounts, nil
 }
 
 func (vault *vaultClient) ListUsers(authPath string) (*[]string, error) {
-	secret, err := vault.Client.Logical().List("auth/userpass/users")
+	secret, err := vault.Client.Logical().List(path.Join("auth", authPath, "users"))
 	if err != nil {
 		log.Error(err)
+		return nil, errors.New("Failed to list users of " + authPath)
 	}
 	if secret == nil {
 		return &[]string{}, nil
@@ -96,10 +247,11 @@ func (vault *vaultClient) ListUsers(authPath string) (*[]string, error) {
 	return &accountIDs, nil
 }
 
-func (vault *vaultClient) GetUser(userID string) (*userAccount, error) {
-	secret, err := vault.Client.Logical().Read("auth/userpass/users/" + userID)
+func (vault *vaultClient) GetUser(authPath string, userID string) (*userAccount, error) {
+	secret, err := vault.Client.Logical().Read(path.Join("auth", authPath, "users", userID))
 	if err != nil {
 		log.Error(err)
+		return nil, errors.New("Failed to read user " + userID)
 	}
 	if secret == nil {
 		return nil, nil
@@ -107,9 +259,10 @@ func (vault *vaultClient) GetUser(userID string) (*userAccount, error) {
 
 	user := userAccount{
 		Name:     userID,
-		Policies: strings.Split(getStringFromMap(&secret.Data, "policies", ""), ","),
-		Ttl:      getStringFromMap(&secret.Data, "ttl", ""),
-		MaxTtl:   getStringFromMap(&secret.Data, "max_ttl", ""),
+		Mount:    authPath,
+		Policies: getStringListFromMap(&secret.Data, "policies"),
+		Ttl:      getStringFromMap(&secret.Data, "ttl", "0"),
+		MaxTtl:   getStringFromMap(&secret.Data, "max_ttl", "0"),
 	}
 
 	return &user, nil
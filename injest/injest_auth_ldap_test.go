@@ -19,6 +19,7 @@ package injest
 
 import (
 	"config2vault/log"
+	"os"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -73,5 +74,41 @@ func TestInjestAuthLdap(t *testing.T) {
 			err := injestConfig(vault, &policies)
 			So(err, ShouldBeNil)
 		})
+		Convey("unchanged config is not rewritten", func() {
+			os.Setenv("LDAP_BINDPASS", "secret")
+			defer os.Unsetenv("LDAP_BINDPASS")
+
+			policies := vaultConfig{
+				AuthBackends: []authBackendInfo{
+					authBackendInfo{
+						Type:        "ldap",
+						Description: "ldap",
+						Config: []map[string]interface{}{
+							map[string]interface{}{
+								"write_policy": "write_once",
+								"properties": map[string]interface{}{
+									"url":      "ldaps://ldap.example.com",
+									"userattr": "uid",
+									"userdn":   "ou=Users,dc=example,dc=com",
+									"binddn":   "cn=vault,dc=example,dc=com",
+									"bindpass": "env:LDAP_BINDPASS",
+									"starttls": true,
+								},
+							},
+						},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 0)
+
+			config, err := vault.Client.Logical().Read("auth/ldap/config")
+			So(err, ShouldBeNil)
+			So(getStringFromMap(&config.Data, "userattr", ""), ShouldEqual, "uid")
+		})
 	})
 }
@@ -0,0 +1,128 @@
+// +build integration
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+
+func TestInjestAuthRoles(t *testing.T) {
+	t.Skip("skipping test for now.")
+
+	log.SetLevel(log.ErrorLevel)
+
+	testEnvPath := "../testing/integration/vault_1x/docker-compose.yml"
+
+	vault, key, deferFn, err := createTestProject(testEnvPath, "", "", "", nil, false)
+	if deferFn != nil {
+		defer deferFn()
+	}
+	if err != nil {
+		t.Fatal("Failed to initialize Vault client")
+	}
+	if key == "" {
+		t.Fatal("Got an Empty security key")
+	}
+
+	Convey("Auth roles", t, func() {
+		policies := vaultConfig{
+			AuthBackends: []authBackendInfo{
+				authBackendInfo{Type: "kubernetes", Path: "kubernetes"},
+				authBackendInfo{Type: "cert", Path: "cert"},
+			},
+			AuthRoles: []authRole{
+				authRole{
+					Mount: "kubernetes",
+					Name:  "app",
+					Properties: propertyBag{
+						"bound_service_account_names":      []interface{}{"app"},
+						"bound_service_account_namespaces": []interface{}{"default"},
+						"token_policies":                   []interface{}{"app"},
+						"token_ttl":                        "1h",
+					},
+				},
+				authRole{
+					Mount:      "cert",
+					Collection: "certs",
+					Name:       "web",
+					Properties: propertyBag{
+						"certificate":    "@../testing/integration/pki/ssl/ca.crt",
+						"token_policies": "web",
+					},
+				},
+			},
+		}
+
+		Convey("Roles are created in their collections", func() {
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			role, err := vault.Client.Logical().Read("auth/kubernetes/role/app")
+			So(err, ShouldBeNil)
+			So(role, ShouldNotBeNil)
+			So(getStringArrayFromMap(&role.Data, "bound_service_account_names", nil), ShouldResemble, []string{"app"})
+
+			cert, err := vault.Client.Logical().Read("auth/cert/certs/web")
+			So(err, ShouldBeNil)
+			So(cert, ShouldNotBeNil)
+			So(getStringFromMap(&cert.Data, "certificate", ""), ShouldContainSubstring, "BEGIN CERTIFICATE")
+		})
+		Convey("Roles are converged and pruned", func() {
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 0)
+
+			_, err = vault.Client.Logical().Write("auth/kubernetes/role/runaway", map[string]interface{}{
+				"bound_service_account_names":      "runaway",
+				"bound_service_account_namespaces": "default",
+			})
+			So(err, ShouldBeNil)
+			policies.AuthRoles[0].Properties["token_ttl"] = "2h"
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 1)
+			So(vault.summary.count(actionDeleted), ShouldEqual, 1)
+
+			role, err := vault.Client.Logical().Read("auth/kubernetes/role/runaway")
+			So(err, ShouldBeNil)
+			So(role, ShouldBeNil)
+		})
+		Convey("Last role of a collection is pruned", func() {
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			policies.AuthRoles = policies.AuthRoles[:1]
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionDeleted), ShouldEqual, 1)
+
+			cert, err := vault.Client.Logical().Read("auth/cert/certs/web")
+			So(err, ShouldBeNil)
+			So(cert, ShouldBeNil)
+		})
+		Convey("Unknown collections are rejected", func() {
+			policies.AuthRoles[1].Collection = "groups"
+			err := injestConfig(vault, &policies)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -68,7 +68,7 @@ func TestInjestConsulBackend(t *testing.T) {
 					{
 						Name: "readonly",
 						Path: mountPath,
-						Properties: map[string]string{
+						Properties: propertyBag{
 							//"policy": `key "" {
 							//		policy = "read"
 							//	}`,
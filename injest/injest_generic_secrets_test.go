@@ -19,6 +19,10 @@ package injest
 
 import (
 	"config2vault/log"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -101,6 +105,200 @@ func TestInjestGenericSecrets(t *testing.T) {
 			So(getStringFromMap(&secret.Data, "zip", ""), ShouldEqual, "zap")
 			So(getStringFromMap(&secret.Data, "bar", ""), ShouldEqual, "clap")
 		})
+		Convey("Unchanged secret is not rewritten", func() {
+			secretPath := "test/foo"
+			policies := vaultConfig{
+				Secrets: []genericSecret{
+					genericSecret{
+						Path: secretPath,
+						Fields: []fieldPair{
+							fieldPair{
+								Key:   "zip",
+								Value: "zap",
+							},
+						},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+			So(vault.summary.count(actionUnchanged), ShouldEqual, 1)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 0)
+
+			policies.Secrets[0].Fields[0].Value = "zop"
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 1)
+			So(vault.summary.Changes[0].Keys, ShouldResemble, []string{"zip"})
+		})
+		Convey("Typed secret values are stored", func() {
+			secretPath := "test/typed"
+			policies := vaultConfig{
+				Secrets: []genericSecret{
+					genericSecret{
+						Path: secretPath,
+						Fields: []fieldPair{
+							{Key: "port", Value: 5432},
+							{Key: "enabled", Value: true},
+							{Key: "hosts", Value: []interface{}{"db1", "db2"}},
+							{Key: "limits", Value: map[interface{}]interface{}{"max": 10}},
+							{Key: "name", Value: "5432"},
+						},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+
+			secret, err := vault.Client.Logical().Read("secret/" + secretPath)
+			So(err, ShouldBeNil)
+			So(getIntFromMap(&secret.Data, "port", 0), ShouldEqual, 5432)
+			So(getBoolFromMap(&secret.Data, "enabled", false), ShouldBeTrue)
+			So(getStringArrayFromMap(&secret.Data, "hosts", nil), ShouldResemble, []string{"db1", "db2"})
+			So(getStringFromMap(&secret.Data, "name", ""), ShouldEqual, "5432")
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 0)
+		})
+		Convey("Merge mode keeps the fields written by the application", func() {
+			secretPath := "test/shared"
+			_, err := vault.Client.Logical().Write("secret/"+secretPath, map[string]interface{}{
+				"host":  "db.local",
+				"token": "rotated-by-app",
+			})
+			So(err, ShouldBeNil)
+
+			policies := vaultConfig{
+				Secrets: []genericSecret{
+					genericSecret{
+						Path: secretPath,
+						Mode: "merge",
+						Fields: []fieldPair{
+							{Key: "host", Value: "db.example.com"},
+							{Key: "username", Value: "app"},
+						},
+					},
+				},
+			}
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+
+			secret, err := vault.Client.Logical().Read("secret/" + secretPath)
+			So(err, ShouldBeNil)
+			So(getStringFromMap(&secret.Data, "host", ""), ShouldEqual, "db.example.com")
+			So(getStringFromMap(&secret.Data, "username", ""), ShouldEqual, "app")
+			So(getStringFromMap(&secret.Data, "token", ""), ShouldEqual, "rotated-by-app")
+		})
+		Convey("Create only secret is never overwritten", func() {
+			secretPath := "test/bootstrap"
+			policies := vaultConfig{
+				Secrets: []genericSecret{
+					genericSecret{
+						Path:   secretPath,
+						Mode:   "create_only",
+						Fields: []fieldPair{{Key: "password", Value: "initial"}},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+
+			_, err = vault.Client.Logical().Write("secret/"+secretPath, map[string]interface{}{
+				"password": "changed",
+			})
+			So(err, ShouldBeNil)
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+
+			secret, err := vault.Client.Logical().Read("secret/" + secretPath)
+			So(err, ShouldBeNil)
+			So(getStringFromMap(&secret.Data, "password", ""), ShouldEqual, "changed")
+		})
+		Convey("Generated value is created once", func() {
+			secretPath := "test/generated"
+			policies := vaultConfig{
+				Secrets: []genericSecret{
+					genericSecret{
+						Path: secretPath,
+						Fields: []fieldPair{
+							{Key: "user", Value: "app"},
+							{Key: "password", Generate: &generateSpec{Length: 24}},
+							{Key: "hmac", Generate: &generateSpec{Type: "hex", Bytes: 16}},
+						},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+			So(vault.summary.count(actionGenerated), ShouldEqual, 1)
+
+			secret, err := vault.Client.Logical().Read("secret/" + secretPath)
+			So(err, ShouldBeNil)
+			password := getStringFromMap(&secret.Data, "password", "")
+			So(len(password), ShouldEqual, 24)
+			So(len(getStringFromMap(&secret.Data, "hmac", "")), ShouldEqual, 32)
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+			So(vault.summary.count(actionGenerated), ShouldEqual, 0)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 0)
+
+			secret, err = vault.Client.Logical().Read("secret/" + secretPath)
+			So(err, ShouldBeNil)
+			So(getStringFromMap(&secret.Data, "password", ""), ShouldEqual, password)
+		})
+		Convey("Secrets are loaded from files", func() {
+			dir, err := ioutil.TempDir("", "secrets")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			So(ioutil.WriteFile(filepath.Join(dir, "app.env"), []byte("# comment\nDB_USER=app\nexport DB_PASS=\"s3cr3t\"\n"), 0600), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, "api.json"), []byte(`{"port": 8080, "debug": true}`), 0600), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, "jdbc.properties"), []byte("jdbc.url = jdbc:postgresql://db/app\\\n    ?sslmode=require\nbanner=line1\\nline2\nmap\\=key = C:\\\\dir\\\\\n"), 0600), ShouldBeNil)
+
+			policies := vaultConfig{
+				Secrets: []genericSecret{
+					genericSecret{
+						Path:     "test/app",
+						FromFile: filepath.Join(dir, "app.env"),
+						Fields: []fieldPair{
+							{Key: "DB_USER", Value: "override"},
+						},
+					},
+					genericSecret{
+						Path:     "test/files",
+						FromFile: dir,
+					},
+				},
+			}
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+
+			secret, err := vault.Client.Logical().Read("secret/test/app")
+			So(err, ShouldBeNil)
+			So(secret.Data["DB_USER"], ShouldEqual, "override")
+			So(secret.Data["DB_PASS"], ShouldEqual, "s3cr3t")
+
+			secret, err = vault.Client.Logical().Read("secret/test/files/api")
+			So(err, ShouldBeNil)
+			So(secret.Data["debug"], ShouldEqual, true)
+			So(fmt.Sprintf("%v", secret.Data["port"]), ShouldEqual, "8080")
+
+			secret, err = vault.Client.Logical().Read("secret/test/files/jdbc")
+			So(err, ShouldBeNil)
+			So(secret.Data["jdbc.url"], ShouldEqual, "jdbc:postgresql://db/app?sslmode=require")
+			So(secret.Data["banner"], ShouldEqual, "line1\nline2")
+			So(secret.Data["map=key"], ShouldEqual, `C:\dir\`)
+
+			secret, err = vault.Client.Logical().Read("secret/test/files/app")
+			So(err, ShouldBeNil)
+			So(secret.Data["DB_USER"], ShouldEqual, "app")
+		})
 		Convey("Remove all secrets if section is present and empty", nil) // See the "Secret is removed if not on the list" test
 		Convey("Secret is removed if not on the list", func() {
 			secretPath := "test/bar"
@@ -148,3 +346,159 @@ func TestInjestGenericSecrets(t *testing.T) {
 		})
 	})
 }
+
+func TestInjestKv2Secrets(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+
+	testEnvPath := "../testing/integration/vault_1x/docker-compose.yml"
+
+	vault, key, deferFn, err := createTestProject(testEnvPath, "", "", "", nil, false)
+	if deferFn != nil {
+		defer deferFn()
+	}
+	if err != nil {
+		t.Fatal("Failed to initialize Vault client")
+	}
+	if key == "" {
+		t.Fatal("Got an Empty security key")
+	}
+
+	kv2Mount := mountInfo{
+		Type:    "kv",
+		Path:    "kv2",
+		Options: map[string]string{"version": "2"},
+		Prune:   "destroy",
+	}
+
+	Convey("KV version 2 Backend", t, func() {
+		Convey("Secret and metadata are stored", func() {
+			secretPath := "test/foo"
+			policies := vaultConfig{
+				Mounts: []mountInfo{kv2Mount},
+				Secrets: []genericSecret{
+					genericSecret{
+						Mount: kv2Mount.Path,
+						Path:  secretPath,
+						Fields: []fieldPair{
+							fieldPair{
+								Key:   "zip",
+								Value: "zap",
+							},
+						},
+						Metadata: &kvMetadata{
+							MaxVersions: 5,
+							CasRequired: true,
+						},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			secret, err := vault.Client.Logical().Read("kv2/data/" + secretPath)
+			So(err, ShouldBeNil)
+			So(secret, ShouldNotBeNil)
+			data := getStringMapInterfaceFromMap(&secret.Data, "data", nil)
+			So(data, ShouldNotBeNil)
+			So(getStringFromMap(data, "zip", ""), ShouldEqual, "zap")
+
+			metadata, err := vault.Client.Logical().Read("kv2/metadata/" + secretPath)
+			So(err, ShouldBeNil)
+			So(getIntFromMap(&metadata.Data, "max_versions", 0), ShouldEqual, 5)
+			So(getBoolFromMap(&metadata.Data, "cas_required", false), ShouldBeTrue)
+
+			// Second write goes through check-and-set
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+		})
+		Convey("Secrets are stored on several mounts", func() {
+			policies := vaultConfig{
+				Mounts: []mountInfo{
+					kv2Mount,
+					{Type: "kv", Path: "team-a-kv"},
+					{Type: "kv", Path: "ci", Prune: "none"},
+				},
+				Secrets: []genericSecret{
+					{
+						Mount:  "team-a-kv",
+						Path:   "db",
+						Fields: []fieldPair{{Key: "user", Value: "team-a"}},
+					},
+					{
+						Path:   "/ci/deploy/key",
+						Fields: []fieldPair{{Key: "key", Value: "abc"}},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			secret, err := vault.Client.Logical().Read("team-a-kv/db")
+			So(err, ShouldBeNil)
+			So(getStringFromMap(&secret.Data, "user", ""), ShouldEqual, "team-a")
+
+			secret, err = vault.Client.Logical().Read("ci/deploy/key")
+			So(err, ShouldBeNil)
+			So(getStringFromMap(&secret.Data, "key", ""), ShouldEqual, "abc")
+
+			// 'ci' is managed but not pruned: the leftover secret survives
+			_, err = vault.Client.Logical().Write("ci/leftover", map[string]interface{}{"key": "left"})
+			So(err, ShouldBeNil)
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionSkipped), ShouldBeGreaterThan, 0)
+
+			secrets, err := vault.ListMountSecrets("ci")
+			So(err, ShouldBeNil)
+			So(*secrets, ShouldContainKey, "deploy/key")
+			So(*secrets, ShouldContainKey, "leftover")
+		})
+		Convey("Soft-deleted secret is not deleted again", func() {
+			softMount := mountInfo{
+				Type:    "kv",
+				Path:    "kv2-soft",
+				Options: map[string]string{"version": "2"},
+			}
+			policies := vaultConfig{
+				Mounts: []mountInfo{softMount},
+				Secrets: []genericSecret{
+					{Mount: softMount.Path, Path: "kept", Fields: []fieldPair{{Key: "a", Value: "1"}}},
+					{Mount: softMount.Path, Path: "dropped", Fields: []fieldPair{{Key: "b", Value: "2"}}},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			policies.Secrets = policies.Secrets[:1]
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionDeleted), ShouldEqual, 1)
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionDeleted), ShouldEqual, 0)
+		})
+		Convey("Secret is destroyed if not on the list", func() {
+			policies := vaultConfig{
+				Mounts: []mountInfo{kv2Mount},
+				Secrets: []genericSecret{
+					{
+						Mount:  kv2Mount.Path,
+						Path:   "test/bar",
+						Fields: []fieldPair{{Key: "zip", Value: "zap"}},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			secrets, err := vault.ListMountSecrets(kv2Mount.Path)
+			So(err, ShouldBeEmpty)
+			So(*secrets, ShouldNotContainKey, "test/foo")
+
+			metadata, err := vault.Client.Logical().Read("kv2/metadata/test/foo")
+			So(err, ShouldBeNil)
+			So(metadata, ShouldBeNil)
+		})
+	})
+}
@@ -144,6 +144,51 @@ func TestInjestMounts(t *testing.T) {
 			So(ok, ShouldBeTrue)
 
 		})
+		Convey("Roles are rejected on mounts without roles", func() {
+			policies := vaultConfig{
+				Mounts: []mountInfo{
+					{
+						Type: "transit",
+						Path: "transit",
+					},
+				},
+				Roles: []rolePolicy{
+					{
+						Name:       "app",
+						Path:       "transit",
+						Properties: propertyBag{"key": "value"},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldNotBeNil)
+
+			// The rules are rejected before anything is changed
+			mounts, err := vault.ListMounts()
+			So(err, ShouldBeNil)
+			_, ok := (*mounts)["transit"]
+			So(ok, ShouldBeFalse)
+
+			_, err = checkConfig(vault, &policies)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Unknown mount keys are rejected", func() {
+			policies := vaultConfig{
+				Mounts: []mountInfo{
+					{
+						Type:     "database",
+						Path:     "db",
+						Sections: map[string]interface{}{"conections": []interface{}{}},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldNotBeNil)
+
+			policies.Mounts[0].Sections = map[string]interface{}{"prnue": "none"}
+			_, err = checkConfig(vault, &policies)
+			So(err, ShouldNotBeNil)
+		})
 		Convey("Mount is removed if not anymore on the list", nil)
 	})
 }
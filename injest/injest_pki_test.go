@@ -73,7 +73,7 @@ func TestInjestPkiBackend(t *testing.T) {
 					{
 						Name: "example-dot-com",
 						Path: mountPath,
-						Properties: map[string]string{
+						Properties: propertyBag{
 							"allowed_domains":  "example.com",
 							"allow_subdomains": "true",
 							"max_ttl":          "72h",
@@ -82,7 +82,7 @@ func TestInjestPkiBackend(t *testing.T) {
 					{
 						Name: "test-dot-local",
 						Path: mountPath,
-						Properties: map[string]string{
+						Properties: propertyBag{
 							"allow_any_name":   "true",
 							"allowed_domains":  "example.com",
 							"allow_subdomains": "true",
@@ -122,6 +122,50 @@ func TestInjestPkiBackend(t *testing.T) {
 			commonName := pub.Subject.CommonName
 			So(commonName, ShouldEqual, "blah.example.com")
 		})
+		Convey("Role drift is detected", func() {
+			policies := vaultConfig{
+				Mounts: []mountInfo{
+					{
+						Path:        "pki",
+						Type:        "pki",
+						MaxLeaseTTL: "87600h",
+					},
+				},
+				Roles: []rolePolicy{
+					{
+						Name: "example-dot-com",
+						Path: "pki",
+						Properties: propertyBag{
+							"allowed_domains":  []interface{}{"example.com"},
+							"allow_subdomains": true,
+							"max_ttl":          "72h",
+						},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 0)
+			So(vault.summary.count(actionUnchanged), ShouldBeGreaterThan, 0)
+
+			_, err = vault.Client.Logical().Write("pki/roles/example-dot-com", map[string]interface{}{
+				"allowed_domains":  "example.com,example.net",
+				"allow_subdomains": true,
+				"max_ttl":          "72h",
+			})
+			So(err, ShouldBeNil)
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeEmpty)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 1)
+
+			role, err := vault.GetRole("pki/roles", "example-dot-com")
+			So(err, ShouldBeNil)
+			So(valuesEqual([]string{"example.com"}, role.Properties["allowed_domains"]), ShouldBeTrue)
+		})
 		Convey("Use intermediate CA", func() {
 			mountType := "pki"
 			mountPath := "pki"
@@ -148,7 +192,7 @@ func TestInjestPkiBackend(t *testing.T) {
 					{
 						Name: "example-dot-com",
 						Path: mountPath,
-						Properties: map[string]string{
+						Properties: propertyBag{
 							"allowed_domains":  "example.com",
 							"allow_subdomains": "true",
 							"max_ttl":          "72h",
@@ -157,7 +201,7 @@ func TestInjestPkiBackend(t *testing.T) {
 					{
 						Name: "test-dot-local",
 						Path: mountPath,
-						Properties: map[string]string{
+						Properties: propertyBag{
 							"allow_any_name":   "true",
 							"allowed_domains":  "example.com",
 							"allow_subdomains": "true",
@@ -229,7 +273,7 @@ func TestInjestPkiBackend(t *testing.T) {
 					{
 						Name: "example-dot-com",
 						Path: mountPath,
-						Properties: map[string]string{
+						Properties: propertyBag{
 							"allowed_domains":  "example.com",
 							"allow_subdomains": "true",
 							"max_ttl":          "8h",
@@ -324,7 +368,7 @@ func TestInjestPkiBackend(t *testing.T) {
 					{
 						Name: "sign-cert",
 						Path: mountPath,
-						Properties: map[string]string{
+						Properties: propertyBag{
 							//"allowed_domains":     "sign",
 							"allow_bare_domains": "true",
 							//"organization ":       "Some Organization",
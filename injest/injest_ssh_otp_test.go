@@ -60,7 +60,7 @@ func TestInjestSshOtpBackend(t *testing.T) {
 					{
 						Name: "otp_key_role",
 						Path: mountPath,
-						Properties: map[string]string{
+						Properties: propertyBag{
 							"key_type":     "otp",
 							"default_user": "admin",
 							"cidr_list":    "172.17.0.5/32",
@@ -96,7 +96,7 @@ func TestInjestSshOtpBackend(t *testing.T) {
 			password := getStringFromMap(&secret.Data, "key", "")
 			So(password, ShouldNotBeBlank)
 
-			roles, err := vault.ListRoles(ssh)
+			roles, err := vault.ListRoles(ssh.Path + "/roles")
 			log.Debugf("Found %d roles", len(roles))
 			for id, role := range roles {
 				log.Debugf("Role: id %s, role: %s", id, role)
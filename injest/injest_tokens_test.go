@@ -0,0 +1,184 @@
+// +build integration
+/*
+ * Copyright 2016 Igor Moochnick
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package injest
+
+import (
+	"config2vault/log"
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInjestTokens(t *testing.T) {
+	t.Skip("skipping test for now.")
+
+	log.SetLevel(log.ErrorLevel)
+
+	testEnvPath := "../testing/integration/vault_1x/docker-compose.yml"
+
+	vault, key, deferFn, err := createTestProject(testEnvPath, "", "", "", nil, false)
+	if deferFn != nil {
+		defer deferFn()
+	}
+	if err != nil {
+		t.Fatal("Failed to initialize Vault client")
+	}
+	if key == "" {
+		t.Fatal("Got an Empty security key")
+	}
+
+	Convey("Token audit", t, func() {
+		Convey("Unexpected tokens are reported and revoked", func() {
+			policies := vaultConfig{
+				Policies: []policyDefiniton{
+					policyDefiniton{
+						Name:  "app",
+						Rules: `path "secret/*" { capabilities = ["read"] }`,
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			expected, err := vault.Client.Auth().Token().Create(&vaultapi.TokenCreateRequest{Policies: []string{"app"}})
+			So(err, ShouldBeNil)
+			root, err := vault.Client.Auth().Token().Create(&vaultapi.TokenCreateRequest{Policies: []string{"root"}})
+			So(err, ShouldBeNil)
+			rogue, err := vault.Client.Auth().Token().Create(&vaultapi.TokenCreateRequest{Policies: []string{"rogue"}})
+			So(err, ShouldBeNil)
+
+			findings, err := checkConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(findings, ShouldEqual, 2)
+
+			policies.Tokens = &tokenAudit{RevokeUnexpectedTokens: true}
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			token, err := vault.LookupTokenAccessor(root.Auth.Accessor)
+			So(err, ShouldBeNil)
+			So(token, ShouldBeNil)
+
+			token, err = vault.LookupTokenAccessor(rogue.Auth.Accessor)
+			So(err, ShouldBeNil)
+			So(token, ShouldBeNil)
+
+			token, err = vault.LookupTokenAccessor(expected.Auth.Accessor)
+			So(err, ShouldBeNil)
+			So(token, ShouldNotBeNil)
+			So(token.Policies, ShouldContain, "app")
+		})
+		Convey("Wrapped SecretIDs survive the audit", func() {
+			policies := vaultConfig{
+				AuthBackends: []authBackendInfo{
+					authBackendInfo{
+						Type: "approle",
+					},
+				},
+				AppRoles: []appRoleProperties{
+					appRoleProperties{
+						Name: "deploy",
+					},
+				},
+				Tokens: &tokenAudit{RevokeUnexpectedTokens: true},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			appRole, err := findAppRole(&policies, "deploy")
+			So(err, ShouldBeNil)
+			wrapped, err := vault.wrapAppRoleSecretID(appRole, &secretIdDelivery{})
+			So(err, ShouldBeNil)
+
+			_, err = checkConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			for _, finding := range vault.summary.Findings {
+				So(finding.Path, ShouldNotEndWith, wrapped.Accessor)
+			}
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			unwrapped, err := vault.Client.Logical().Write("sys/wrapping/unwrap", map[string]interface{}{
+				"token": wrapped.Token,
+			})
+			So(err, ShouldBeNil)
+			So(getStringFromMap(&unwrapped.Data, "secret_id", ""), ShouldNotBeEmpty)
+		})
+		Convey("Token roles are converged", func() {
+			renewable := false
+			policies := vaultConfig{
+				TokenRoles: &tokenRolesConfig{Roles: []tokenRole{
+					tokenRole{
+						Name:               "orchestrator",
+						AllowedPolicies:    []string{"app", "worker"},
+						DisallowedPolicies: []string{"root"},
+						Orphan:             true,
+						Period:             "1h",
+						Renewable:          &renewable,
+						ExplicitMaxTtl:     "24h",
+						PathSuffix:         "v1",
+						BoundCidrs:         stringList{"10.0.0.0/8"},
+					},
+				}},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			role, err := vault.GetTokenRole("orchestrator")
+			So(err, ShouldBeNil)
+			So(role.AllowedPolicies, ShouldResemble, []string{"app", "worker"})
+			So(role.Orphan, ShouldBeTrue)
+			So(role.Period, ShouldEqual, "3600")
+			So(*role.Renewable, ShouldBeFalse)
+			So(role.PathSuffix, ShouldEqual, "v1")
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 0)
+
+			_, err = vault.Client.Logical().Write("auth/token/roles/runaway", map[string]interface{}{})
+			So(err, ShouldBeNil)
+			policies.TokenRoles.Roles[0].Period = "2h"
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 1)
+
+			role, err = vault.GetTokenRole("runaway")
+			So(err, ShouldBeNil)
+			So(role, ShouldBeNil)
+
+			_, err = vault.Client.Logical().Write("auth/token/roles/manual", map[string]interface{}{})
+			So(err, ShouldBeNil)
+			policies.TokenRoles.Prune = authPruneNone
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			role, err = vault.GetTokenRole("manual")
+			So(err, ShouldBeNil)
+			So(role, ShouldNotBeNil)
+
+			// Rules without the section leave the token roles alone
+			err = injestConfig(vault, &vaultConfig{})
+			So(err, ShouldBeNil)
+			role, err = vault.GetTokenRole("orchestrator")
+			So(err, ShouldBeNil)
+			So(role, ShouldNotBeNil)
+		})
+	})
+}
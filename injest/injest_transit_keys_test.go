@@ -90,5 +90,150 @@ func TestInjestTransitKeys(t *testing.T) {
 			content, _ := b64.StdEncoding.DecodeString(result)
 			So(string(content), ShouldEqual, testContent)
 		})
+		Convey("Key config is converged and the key is rotated", func() {
+			keyName := "configured_key"
+			policies := vaultConfig{
+				Mounts: []mountInfo{
+					mountInfo{
+						Path: "transit",
+						Type: "transit",
+					},
+				},
+				TransitKeys: []transitKey{
+					transitKey{
+						Name:            keyName,
+						Derived:         true,
+						DeletionAllowed: true,
+						Exportable:      true,
+						RotateAfter:     "1ns",
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			secret, err := vault.Client.Logical().Read("transit/keys/" + keyName)
+			So(err, ShouldBeNil)
+			So(secret.Data["derived"], ShouldEqual, true)
+			So(secret.Data["deletion_allowed"], ShouldEqual, true)
+			So(secret.Data["exportable"], ShouldEqual, true)
+			So(getIntFromMap(&secret.Data, "latest_version", 0), ShouldBeGreaterThan, 1)
+
+			policies.TransitKeys[0].RotateAfter = ""
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 0)
+		})
+		Convey("Keys are created on several transit mounts", func() {
+			policies := vaultConfig{
+				Mounts: []mountInfo{
+					mountInfo{
+						Path: "encryption",
+						Type: "transit",
+					},
+					mountInfo{
+						Path: "tenant-a",
+						Type: "transit",
+					},
+				},
+				TransitKeys: []transitKey{
+					transitKey{
+						Mount: "encryption",
+						Name:  "shared",
+					},
+					transitKey{
+						Mount: "tenant-a",
+						Name:  "shared",
+						Type:  "ecdsa-p256",
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			secret, err := vault.Client.Logical().Read("encryption/keys/shared")
+			So(err, ShouldBeNil)
+			So(secret.Data["type"], ShouldEqual, "aes256-gcm96")
+
+			secret, err = vault.Client.Logical().Read("tenant-a/keys/shared")
+			So(err, ShouldBeNil)
+			So(secret.Data["type"], ShouldEqual, "ecdsa-p256")
+		})
+		Convey("Key on an undeclared mount is rejected", func() {
+			policies := vaultConfig{
+				TransitKeys: []transitKey{
+					transitKey{
+						Mount: "missing",
+						Name:  "key",
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Unmanaged key is removed only if deletion is allowed", func() {
+			_, err := vault.Client.Logical().Write("transit/keys/locked_key", nil)
+			So(err, ShouldBeNil)
+			_, err = vault.Client.Logical().Write("transit/keys/deletable_key", nil)
+			So(err, ShouldBeNil)
+			_, err = vault.Client.Logical().Write("transit/keys/deletable_key/config", map[string]interface{}{
+				"deletion_allowed": true,
+			})
+			So(err, ShouldBeNil)
+
+			policies := vaultConfig{
+				Mounts: []mountInfo{
+					mountInfo{
+						Path: "transit",
+						Type: "transit",
+					},
+				},
+			}
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			secret, err := vault.Client.Logical().Read("transit/keys/locked_key")
+			So(err, ShouldBeNil)
+			So(secret, ShouldNotBeNil)
+
+			secret, err = vault.Client.Logical().Read("transit/keys/deletable_key")
+			So(err, ShouldBeNil)
+			So(secret, ShouldBeNil)
+		})
+		Convey("Keys are declared on the mount and kept with prune none", func() {
+			_, err := vault.Client.Logical().Write("transit/keys/kept_key", nil)
+			So(err, ShouldBeNil)
+			_, err = vault.Client.Logical().Write("transit/keys/kept_key/config", map[string]interface{}{
+				"deletion_allowed": true,
+			})
+			So(err, ShouldBeNil)
+
+			policies := vaultConfig{
+				Mounts: []mountInfo{
+					mountInfo{
+						Path:  "transit",
+						Type:  "transit",
+						Prune: "none",
+						Sections: map[string]interface{}{
+							"keys": []transitKey{
+								transitKey{
+									Name: "mount_key",
+								},
+							},
+						},
+					},
+				},
+			}
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			secret, err := vault.Client.Logical().Read("transit/keys/mount_key")
+			So(err, ShouldBeNil)
+			So(secret, ShouldNotBeNil)
+
+			secret, err = vault.Client.Logical().Read("transit/keys/kept_key")
+			So(err, ShouldBeNil)
+			So(secret, ShouldNotBeNil)
+		})
 	})
 }
@@ -64,7 +64,7 @@ func TestInjestUserAccounts(t *testing.T) {
 			err := injestConfig(vault, &policies)
 			So(err, ShouldBeNil)
 
-			user, err := vault.GetUser(userName)
+			user, err := vault.GetUser("userpass", userName)
 			So(err, ShouldBeNil)
 			So(user.Name, ShouldEqual, userName)
 			So(len(user.Policies), ShouldEqual, 2)
@@ -92,14 +92,136 @@ func TestInjestUserAccounts(t *testing.T) {
 			err = injestConfig(vault, &policies)
 			So(err, ShouldBeNil)
 
-			user, err = vault.GetUser(userName)
+			user, err = vault.GetUser("userpass", userName)
 			So(err, ShouldBeNil)
 			So(user.Name, ShouldEqual, userName)
 			So(len(user.Policies), ShouldEqual, 2)
 			So(user.Policies, ShouldContain, "default")
 			So(user.Policies, ShouldContain, "policy2")
 
-			// TODO: validate that error is descriptively asking to mount Auth backend
+		})
+		Convey("User on an undeclared auth backend is rejected", func() {
+			policies := vaultConfig{
+				Users: []userAccount{
+					userAccount{
+						Name:     "test",
+						Password: "secret",
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("TTLs are applied and unchanged user is not rewritten", func() {
+			policies := vaultConfig{
+				AuthBackends: []authBackendInfo{
+					authBackendInfo{
+						Type: "userpass",
+					},
+				},
+				Users: []userAccount{
+					userAccount{
+						Name:           "ttl-user",
+						Password:       "secret",
+						PasswordPolicy: "set_once",
+						Policies:       []string{"policy1"},
+						Ttl:            "1h",
+						MaxTtl:         "24h",
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			user, err := vault.GetUser("userpass", "ttl-user")
+			So(err, ShouldBeNil)
+			So(user.Ttl, ShouldEqual, "3600")
+			So(user.MaxTtl, ShouldEqual, "86400")
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 0)
+		})
+		Convey("Password reset is not reported as an update", func() {
+			policies := vaultConfig{
+				AuthBackends: []authBackendInfo{
+					authBackendInfo{
+						Type: "userpass",
+					},
+				},
+				Users: []userAccount{
+					userAccount{
+						Name:     "reset-user",
+						Password: "secret",
+						Policies: []string{"policy1"},
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 0)
+			So(vault.summary.count(actionReset), ShouldEqual, 1)
+
+			policies.Users[0].Policies = []string{"policy2"}
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+			So(vault.summary.count(actionUpdated), ShouldEqual, 1)
+			So(vault.summary.count(actionReset), ShouldEqual, 1)
+
+			user, err := vault.GetUser("userpass", "reset-user")
+			So(err, ShouldBeNil)
+			So(user.Policies, ShouldContain, "policy2")
+		})
+		Convey("Runaway users are removed on every userpass backend", func() {
+			policies := vaultConfig{
+				AuthBackends: []authBackendInfo{
+					authBackendInfo{
+						Type: "userpass",
+					},
+					authBackendInfo{
+						Type:  "userpass",
+						Path:  "partners",
+						Prune: "none",
+					},
+				},
+				Users: []userAccount{
+					userAccount{
+						Name:     "keep",
+						Password: "secret",
+					},
+					userAccount{
+						Name:     "partner",
+						Mount:    "partners",
+						Password: "secret",
+					},
+				},
+			}
+			err := injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			_, err = vault.Client.Logical().Write("auth/userpass/users/runaway", map[string]interface{}{"password": "secret"})
+			So(err, ShouldBeNil)
+			_, err = vault.Client.Logical().Write("auth/partners/users/runaway", map[string]interface{}{"password": "secret"})
+			So(err, ShouldBeNil)
+
+			err = injestConfig(vault, &policies)
+			So(err, ShouldBeNil)
+
+			user, err := vault.GetUser("userpass", "runaway")
+			So(err, ShouldBeNil)
+			So(user, ShouldBeNil)
+
+			user, err = vault.GetUser("userpass", "keep")
+			So(err, ShouldBeNil)
+			So(user, ShouldNotBeNil)
+
+			// Backend with 'prune: none' only reports the runaway users
+			user, err = vault.GetUser("partners", "runaway")
+			So(err, ShouldBeNil)
+			So(user, ShouldNotBeNil)
 		})
 	})
 }
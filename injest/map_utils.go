@@ -19,6 +19,7 @@ package injest
 import (
 	"config2vault/log"
 	"encoding/json"
+	"fmt"
 	"reflect"
 	"strconv"
 )
@@ -101,6 +102,24 @@ func getStringArrayFromMap(m *map[string]interface{}, key string, defaultValue [
 	return result
 }
 
+// getStringListFromMap accepts both a list and a comma separated string. Vault returns the lists either way
+// depending on its version.
+func getStringListFromMap(m *map[string]interface{}, key string) []string {
+	if m == nil {
+		return []string{}
+	}
+	switch value := (*m)[key].(type) {
+	case []interface{}:
+		return getStringArrayFromMap(m, key, []string{})
+	case string:
+		if value == "" {
+			return []string{}
+		}
+		return splitList(value)
+	}
+	return []string{}
+}
+
 func getBoolFromMap(m *map[string]interface{}, key string, defaultValue bool) (result bool) {
 	if m == nil {
 		return defaultValue
@@ -143,8 +162,7 @@ func getStringMapInterfaceFromMap(m *map[string]interface{}, key string, default
 			result[key] = v
 		}
 	case map[string]interface{}:
-		log.Debug("nothing")
-		result = make(map[string]interface{})
+		result = value.(map[string]interface{})
 	default:
 		log.Errorf("Failed to convert '%s' value '%v' of type %s to map[interface{}]interface{}", key, value, reflect.TypeOf(value))
 		return defaultValue
@@ -183,4 +201,65 @@ func getStringMapFromStringMapInterface(in map[string]interface{}) map[string]st
 		}
 	}
 	return out
-}
\ No newline at end of file
+}
+
+func getPropertyBag(value interface{}) (propertyBag, bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return propertyBag(value), true
+	case map[string]string:
+		bag := make(propertyBag, len(value))
+		for key, v := range value {
+			bag[key] = v
+		}
+		return bag, true
+	case map[interface{}]interface{}:
+		bag := make(propertyBag, len(value))
+		for key, v := range value {
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, false
+			}
+			bag[keyStr] = v
+		}
+		return bag, true
+	}
+	return nil, false
+}
+
+// toJSONValue converts the YAML maps (map[interface{}]interface{}) of a value into the maps that can be encoded to JSON
+func toJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[fmt.Sprintf("%v", key)] = toJSONValue(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = toJSONValue(item)
+		}
+		return result
+	case map[string]string:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = item
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = toJSONValue(item)
+		}
+		return result
+	case []string:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = item
+		}
+		return result
+	}
+	return value
+}